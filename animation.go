@@ -0,0 +1,323 @@
+package spotpuppy
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+)
+
+// Interpolation is how an animation moves from one keyframe to the next
+type Interpolation string
+
+const (
+	// InterpolationLinear moves at a constant speed between keyframes. This is used if a keyframe has no interpolation
+	InterpolationLinear Interpolation = "linear"
+	// InterpolationStep holds the value of the keyframe until the next keyframe, then jumps
+	InterpolationStep Interpolation = "step"
+	// InterpolationCubic speeds up after the keyframe and slows down before the next one, stopping at every keyframe
+	InterpolationCubic Interpolation = "cubic"
+	// InterpolationCatmullRom moves along a smooth spline through the keyframes, without stopping at each one
+	InterpolationCatmullRom Interpolation = "catmull_rom"
+)
+
+// Keyframe is a set of leg positions and motor angles at a point in time in an animation.
+// Legs and motors that are not in a keyframe are interpolated between the keyframes either side that do have them
+type Keyframe struct {
+	// Time is the time (in seconds) of this keyframe from the start of the animation
+	Time float64 `json:"time"`
+	// Legs is the position of each leg, relative to its shoulder (like SetLegPosition), or to its resting position if the animation is RelativeToRest
+	Legs map[string]Vec3 `json:"legs"`
+	// Motors is the angle of extra motors (see NewQuadrupedWithExtraMotors)
+	Motors map[string]float64 `json:"motors"`
+	// Interpolation is how the animation moves from this keyframe to the next
+	Interpolation Interpolation `json:"interpolation"`
+}
+
+// Animation is a list of keyframes, which can be saved to and loaded from json, and played on a quadruped with an AnimationPlayer
+type Animation struct {
+	Keyframes []Keyframe `json:"keyframes"`
+	// RelativeToRest should be true if leg positions are offsets from the resting position of each leg (like Pose), so the animation works on robots with different leg sizes
+	RelativeToRest bool `json:"relative_to_rest"`
+}
+
+// NewAnimation creates an animation from some keyframes. The keyframes are sorted by time
+func NewAnimation(keyframes ...Keyframe) *Animation {
+	a := &Animation{Keyframes: keyframes}
+	a.sortKeyframes()
+	return a
+}
+
+// LoadAnimationFromFile loads an animation from a json file
+func LoadAnimationFromFile(filename string) (*Animation, error) {
+	s, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	a := &Animation{}
+	err = json.Unmarshal(s, a)
+	if err != nil {
+		return nil, err
+	}
+	a.sortKeyframes()
+	return a, nil
+}
+
+// SaveToFile saves this animation to a json file
+func (a *Animation) SaveToFile(filename string) error {
+	s, err := json.MarshalIndent(a, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, s, 0644)
+}
+
+// Duration returns the time of the last keyframe
+func (a *Animation) Duration() float64 {
+	if len(a.Keyframes) == 0 {
+		return 0
+	}
+	return a.Keyframes[len(a.Keyframes)-1].Time
+}
+
+// SampleLegs returns the position of each animated leg at time t. Before the first keyframe and after the last keyframe, the legs hold still
+func (a *Animation) SampleLegs(t float64) map[string]Vec3 {
+	positions := make(map[string]Vec3)
+	for _, l := range a.names(func(k Keyframe) []string { return legNames(k.Legs) }) {
+		track := make([]trackPoint, 0)
+		for _, k := range a.Keyframes {
+			if v, ok := k.Legs[l]; ok {
+				track = append(track, trackPoint{k.Time, v, k.Interpolation})
+			}
+		}
+		positions[l] = sampleTrack(track, t)
+	}
+	return positions
+}
+
+// SampleMotors returns the angle of each animated extra motor at time t. Before the first keyframe and after the last keyframe, the motors hold still
+func (a *Animation) SampleMotors(t float64) map[string]float64 {
+	angles := make(map[string]float64)
+	for _, m := range a.names(func(k Keyframe) []string { return motorNames(k.Motors) }) {
+		track := make([]trackPoint, 0)
+		for _, k := range a.Keyframes {
+			if v, ok := k.Motors[m]; ok {
+				track = append(track, trackPoint{k.Time, NewVector3(v, 0, 0), k.Interpolation})
+			}
+		}
+		angles[m] = sampleTrack(track, t).X
+	}
+	return angles
+}
+
+// sortKeyframes sorts the keyframes by time
+func (a *Animation) sortKeyframes() {
+	sort.SliceStable(a.Keyframes, func(i, j int) bool { return a.Keyframes[i].Time < a.Keyframes[j].Time })
+}
+
+// names returns every name found in any keyframe by get, without repeats
+func (a *Animation) names(get func(Keyframe) []string) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, k := range a.Keyframes {
+		for _, n := range get(k) {
+			if !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+		}
+	}
+	return names
+}
+
+func legNames(m map[string]Vec3) []string {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	return names
+}
+
+func motorNames(m map[string]float64) []string {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	return names
+}
+
+// trackPoint is a single value of one leg or motor in an animation
+type trackPoint struct {
+	time          float64
+	value         Vec3
+	interpolation Interpolation
+}
+
+// sampleTrack interpolates the points of a track (sorted by time) at time t
+func sampleTrack(track []trackPoint, t float64) Vec3 {
+	if len(track) == 0 {
+		return Zero
+	}
+	if t <= track[0].time {
+		return track[0].value
+	}
+	for i := 0; i < len(track)-1; i++ {
+		a, b := track[i], track[i+1]
+		if t >= b.time {
+			continue
+		}
+		u := (t - a.time) / (b.time - a.time)
+		switch a.interpolation {
+		case InterpolationStep:
+			return a.value
+		case InterpolationCubic:
+			u = EaseCubic(u)
+		case InterpolationCatmullRom:
+			before, after := a.value, b.value
+			if i > 0 {
+				before = track[i-1].value
+			}
+			if i+2 < len(track) {
+				after = track[i+2].value
+			}
+			return catmullRom(before, a.value, b.value, after, u)
+		}
+		return a.value.Add(b.value.Sub(a.value).Mul(u))
+	}
+	return track[len(track)-1].value
+}
+
+// catmullRom evaluates a catmull rom spline between p1 and p2, where p0 comes before p1 and p3 comes after p2
+func catmullRom(p0, p1, p2, p3 Vec3, u float64) Vec3 {
+	u2, u3 := u*u, u*u*u
+	return p0.Mul(-0.5*u3 + u2 - 0.5*u).
+		Add(p1.Mul(1.5*u3 - 2.5*u2 + 1)).
+		Add(p2.Mul(-1.5*u3 + 2*u2 + 0.5*u)).
+		Add(p3.Mul(0.5*u3 - 0.5*u2))
+}
+
+// AnimationPlayer plays an Animation on a quadruped.
+// When it starts playing, it blends from the current leg positions into the animation, and when it stops, it blends back out to the leg positions it started from
+type AnimationPlayer struct {
+	Animation *Animation
+	// Loop should be true if the animation should start again from the beginning when it reaches the end
+	Loop bool
+	// Speed scales how fast the animation plays. 1 is normal speed, and 2 is twice as fast.
+	// A negative speed plays the animation backwards from the end, and 0 is treated as normal speed
+	Speed float64
+	// BlendIn and BlendOut are how long (in seconds) it takes to blend into the animation when it starts, and back out again when it stops
+	BlendIn  float64
+	BlendOut float64
+	robot    *LeggedRobot
+	time     float64
+	elapsed  float64
+	stopTime float64
+	playing  bool
+	stopping bool
+	base     map[string]Vec3
+}
+
+// NewAnimationPlayer creates a new animation player for a quadruped, which plays at normal speed, does not loop, and blends in and out over 0.5 seconds
+func NewAnimationPlayer(q *LeggedRobot, a *Animation) *AnimationPlayer {
+	return &AnimationPlayer{
+		Animation: a,
+		Speed:     1,
+		BlendIn:   0.5,
+		BlendOut:  0.5,
+		robot:     q,
+		base:      make(map[string]Vec3),
+	}
+}
+
+// Play starts the animation from the beginning, blending in from the current leg positions
+func (p *AnimationPlayer) Play() {
+	p.time = 0
+	if p.speed() < 0 {
+		p.time = p.Animation.Duration()
+	}
+	p.elapsed = 0
+	p.playing = true
+	p.stopping = false
+	p.base = make(map[string]Vec3)
+	for l := range p.robot.Legs {
+		p.base[l] = p.robot.GetLegPosition(l)
+	}
+}
+
+// Stop starts blending back out to the leg positions from before the animation started. The animation keeps playing while it blends out
+func (p *AnimationPlayer) Stop() {
+	if p.playing && !p.stopping {
+		p.stopping = true
+		p.stopTime = p.elapsed
+	}
+}
+
+// IsPlaying returns true if the animation is playing or blending out
+func (p *AnimationPlayer) IsPlaying() bool {
+	return p.playing
+}
+
+// Time returns the current time in the animation
+func (p *AnimationPlayer) Time() float64 {
+	return p.time
+}
+
+// speed returns Speed, or 1 if Speed is 0, so an AnimationPlayer that was not made with NewAnimationPlayer still finishes
+func (p *AnimationPlayer) speed() float64 {
+	if p.Speed == 0 {
+		return 1
+	}
+	return p.Speed
+}
+
+// Update runs the animation forwards by dt seconds, and sets the leg positions and extra motors of the quadruped.
+// Blending is not affected by Speed. Extra motors are not blended, as the quadruped does not know their angles before the animation starts
+func (p *AnimationPlayer) Update(dt float64) {
+	if !p.playing {
+		return
+	}
+	p.elapsed += dt
+	p.time += dt * p.speed()
+	duration := p.Animation.Duration()
+	if p.time >= duration || p.time < 0 {
+		if p.Loop && duration > 0 {
+			p.time = math.Mod(p.time, duration)
+			if p.time < 0 {
+				p.time += duration
+			}
+		} else {
+			p.time = clamp(p.time, 0, duration)
+			p.Stop()
+		}
+	}
+	weight := 1.0
+	if p.BlendIn > 0 {
+		weight = math.Min(weight, p.elapsed/p.BlendIn)
+	}
+	if p.stopping {
+		out := 0.0
+		if p.BlendOut > 0 {
+			out = 1 - (p.elapsed-p.stopTime)/p.BlendOut
+		}
+		weight = math.Min(weight, out)
+	}
+	weight = EaseCubic(weight)
+	for l, pos := range p.Animation.SampleLegs(p.time) {
+		base, ok := p.base[l]
+		if !ok {
+			continue
+		}
+		if p.Animation.RelativeToRest {
+			pos = pos.Add(p.robot.Legs[l].GetRestingPosition())
+		}
+		p.robot.SetLegPosition(l, base.Add(pos.Sub(base).Mul(weight)))
+	}
+	if weight > 0 {
+		for m, angle := range p.Animation.SampleMotors(p.time) {
+			p.robot.SetExtraMotorNow(m, angle)
+		}
+	}
+	if p.stopping && weight <= 0 {
+		p.playing = false
+	}
+}
@@ -4,11 +4,18 @@ package spotpuppy
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"time"
 
 	"github.com/tarm/serial"
 )
 
+func init() {
+	RegisterRotationSensor("raw_arduino", func() RotationSensor { return NewRawArduinoRotationSensor() })
+}
+
 type rotationPacket struct {
 	gyroX, gyroY, gyroZ    float64
 	accelX, accelY, accelZ float64
@@ -22,102 +29,188 @@ type RawArduinoRotationSensor struct {
 	ReverseGyroUp      bool          `json:"rev_gyro_up"`
 	ReverseGyroLeft    bool          `json:"rev_gyro_left"`
 	ReverseGyroForward bool          `json:"rev_gyro_forward"`
-	// Maximum number of deg/s the accelerometer can move the rotation
-	AccSpeed    float64 `json:"acc_speed"`
-	calibration rotationPacket
-	cachedRot   Quat
-	stopFlag    bool
-	stoppedFlag bool
+	// Maximum number of deg/s the accelerometer can move the rotation. DEPRECATED: use a ComplementaryFilter as the Filter instead.
+	// This is only used if Filter is nil
+	AccSpeed float64 `json:"acc_speed"`
+	// Filter fuses the gyro and accelerometer readings into a rotation. If it is nil, a ComplementaryFilter with AccSpeed is used.
+	// It should only be changed while the sensor is stopped
+	Filter OrientationFilter `json:"filter"`
+	// Calibration is the calibration of the accelerometer and gyro, which is found by Calibrate and CalibrateSixPosition.
+	// It should only be changed while the sensor is stopped
+	Calibration IMUCalibration `json:"calibration"`
+	backgroundUpdater
 }
 
+// serialReadTimeout is how long a read from the arduino waits for data before giving up, so that the update thread can check if it should stop
+const serialReadTimeout = time.Second / 10
+
+// calibrationTimeout is how long calibration waits for a packet from the arduino before giving up
+const calibrationTimeout = 10 * time.Second
+
+// errStopped is returned by parseNextPacket when it is stopped before a full packet arrives
+var errStopped = errors.New("stopped while waiting for a packet")
+
 // Creates a new sensor instance. Does not connect to the arduino yet, that is done from Setup()
 func NewRawArduinoRotationSensor() *RawArduinoRotationSensor {
-	return &RawArduinoRotationSensor{
-		IsReady:   false,
-		PortName:  "/dev/ttyUSB0",
-		Axes:      NewAxesRemapper(Forward, Left, Up),
-		cachedRot: QuatIdentity,
-		AccSpeed:  180,
+	a := &RawArduinoRotationSensor{
+		IsReady:  false,
+		PortName: "/dev/ttyUSB0",
+		Axes:     NewAxesRemapper(Forward, Left, Up),
+		AccSpeed: 180,
 	}
+	a.backgroundUpdater = newBackgroundUpdater(a.startUpdating)
+	return a
 }
 
-// Sets up and connects to the arduino
-func (a *RawArduinoRotationSensor) Setup() {
-	c := &serial.Config{Name: a.PortName, Baud: 115200}
+// Sets up and connects to the arduino, then starts updating in the background. If the sensor was already set up, it is closed first.
+// Returns an error if the serial port could not be opened
+func (a *RawArduinoRotationSensor) Setup() error {
+	a.Close()
+	c := &serial.Config{Name: a.PortName, Baud: 115200, ReadTimeout: serialReadTimeout}
 	s, err := serial.OpenPort(c)
 	if err != nil {
-		panic("Failed to connect to arduino on port " + a.PortName)
+		return fmt.Errorf("failed to connect to arduino on port %s: %w", a.PortName, err)
 	}
 	s.Flush()
 	a.Port = s
-	go a.updateInBackground()
 	a.IsReady = true
+	return a.Start()
 }
 
-// Restarts the updating in background thread
-func (a *RawArduinoRotationSensor) Restart() {
-	// Wait for update thread to stop
-	a.stoppedFlag = false
-	a.stopFlag = true
-	for !a.stoppedFlag {
-		time.Sleep(time.Second / 10)
+// Close stops updating, and closes the serial port. Setup must be called again before the sensor can be used
+func (a *RawArduinoRotationSensor) Close() error {
+	a.lifecycle.Lock()
+	defer a.lifecycle.Unlock()
+	a.stopAndWait()
+	if a.Port == nil {
+		return nil
 	}
-	// Restart update in background
-	go a.updateInBackground()
+	err := a.Port.Close()
+	a.Port = nil
+	a.IsReady = false
+	return err
 }
 
-// Calibrates the sensors accelerometer and gyro. Ensure the sensor is very flat for this
-func (a *RawArduinoRotationSensor) Calibrate() {
+// Calibrates the sensors gyro, by measuring its bias. The sensor must be very still for this.
+// If the accelerometer has not been calibrated by CalibrateSixPosition, the sensor must also be flat, and the accelerometer offset is found too.
+// Otherwise, the sensor can be in any position, and the accelerometer calibration is kept.
+// If the arduino cannot be read, or sends no packets for 10 seconds, the sensor stops updating and the error is returned (see Restart)
+func (a *RawArduinoRotationSensor) Calibrate() error {
+	a.lifecycle.Lock()
+	defer a.lifecycle.Unlock()
 	if !a.IsReady {
-		panic("Rotation sensor wasn't ready")
+		return errors.New("rotation sensor has not been set up")
 	}
-	// Wait for update thread to stop
-	a.stoppedFlag = false
-	a.stopFlag = true
-	for !a.stoppedFlag {
-		time.Sleep(time.Second / 10)
+	a.stopAndWait()
+
+	// The arduino reads gravity as half a unit upwards
+	c, err := calibrateStill(a.Calibration, Up.Mul(0.5), a.readCalibrationSample)
+	if err != nil {
+		a.setErr(err)
+		return err
+	}
+	a.Calibration = c
+
+	// Restart update in background
+	return a.start()
+}
+
+// CalibrateSixPosition calibrates the offset and scale of each axis of the accelerometer, and the bias of the gyro, with the robot held still in each of SixPositions.
+// Before each position, ready is called with the position, and should return once the robot is still in that position (for example, after asking the user to press enter).
+// Returning an error from ready cancels the calibration. The positions do not need to be exactly level.
+// The results are saved to Calibration, so save the sensor with SaveRotationSensorToFile afterwards to keep them
+func (a *RawArduinoRotationSensor) CalibrateSixPosition(ready func(CalibrationPosition) error) error {
+	a.lifecycle.Lock()
+	defer a.lifecycle.Unlock()
+	if !a.IsReady {
+		return errors.New("rotation sensor has not been set up")
 	}
+	a.stopAndWait()
 
-	// Read the rotation packet
-	d := rotationPacket{}
-	for i := 0; i < 100; i++ {
-		d1 := a.parseNextPacket()
-		d.accelX += d1.accelX
-		// We add 0.5 here as you should take away the maximum force in the direction of u = -1*-0.5 = +0.5
-		d.accelY += d1.accelY + 0.5
-		d.accelZ += d1.accelZ
-		d.gyroX += d1.gyroX
-		d.gyroY += d1.gyroY
-		d.gyroZ += d1.gyroZ
+	c, err := calibrateSixPosition(func(pos CalibrationPosition) error {
+		err := ready(pos)
+		// Throw away the packets sent while the robot was moving into position
+		a.Port.Flush()
+		return err
+	}, a.readCalibrationSample)
+	if err != nil {
+		a.setErr(err)
+		return err
 	}
-	d.accelX /= 100
-	d.accelY /= 100
-	d.accelZ /= 100
-	d.gyroX /= 100
-	d.gyroY /= 100
-	d.gyroZ /= 100
-	a.calibration = d
+	a.Calibration = c
 
 	// Restart update in background
-	go a.updateInBackground()
+	return a.start()
+}
+
+// readCalibrationSample waits for the next packet from the arduino, and returns the raw gyro and accelerometer readings. The update thread must be stopped.
+// It gives up if no packet arrives within calibrationTimeout
+func (a *RawArduinoRotationSensor) readCalibrationSample() (Vec3, Vec3, error) {
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(calibrationTimeout, func() { close(timeout) })
+	defer timer.Stop()
+	p, err := a.parseNextPacket(timeout)
+	if err == errStopped {
+		err = fmt.Errorf("timed out waiting for packets from arduino on port %s", a.PortName)
+	}
+	if err != nil {
+		return Zero, Zero, err
+	}
+	return NewVector3(p.gyroX, p.gyroY, p.gyroZ), NewVector3(p.accelX, p.accelY, p.accelZ), nil
+}
+
+// getFilter returns the filter to use, which is Filter, or a ComplementaryFilter with AccSpeed if there is no Filter
+func (a *RawArduinoRotationSensor) getFilter() OrientationFilter {
+	if a.Filter != nil {
+		return a.Filter
+	}
+	f := NewComplementaryFilter()
+	f.AccSpeed = a.AccSpeed
+	return f
+}
+
+// rawArduinoRotationSensorJSON has the same fields as RawArduinoRotationSensor, but none of its methods, so it can be used inside RawArduinoRotationSensor's json methods
+type rawArduinoRotationSensorJSON RawArduinoRotationSensor
+
+// MarshalJSON saves the sensor, including the registered type name of the filter
+func (a *RawArduinoRotationSensor) MarshalJSON() ([]byte, error) {
+	return marshalWithFilter((*rawArduinoRotationSensorJSON)(a), a.Filter)
 }
 
-// Returns the last measured rotation of the sensor. Non blocking
-func (a *RawArduinoRotationSensor) GetQuaternion() Quat {
-	return a.cachedRot
+// UnmarshalJSON loads the sensor. If the filter was saved with a registered type name, and the existing filter is not already that type,
+// a new filter of that type is created
+func (a *RawArduinoRotationSensor) UnmarshalJSON(data []byte) error {
+	return unmarshalWithFilter(data, (*rawArduinoRotationSensorJSON)(a), &a.Filter)
 }
 
-// This runs constantly in the background so that the update loop always gets the most up to dat info without having to wait
-func (a *RawArduinoRotationSensor) updateInBackground() {
+// startUpdating starts the update thread with a fresh filter. lifecycle must be held.
+// Stopping does not wait for a packet to arrive, so it is quick even if the arduino has stopped sending data
+func (a *RawArduinoRotationSensor) startUpdating(stop <-chan struct{}, done chan<- struct{}) error {
+	if !a.IsReady {
+		return errors.New("rotation sensor has not been set up")
+	}
+	filter := a.getFilter()
+	filter.Reset()
+	go a.updateInBackground(filter, a.Calibration, stop, done)
+	return nil
+}
+
+// This runs constantly in the background so that the update loop always gets the most up to dat info without having to wait.
+// It stops when stop is closed, or when the arduino cannot be read, and closes done when it has stopped
+func (a *RawArduinoRotationSensor) updateInBackground(filter OrientationFilter, calibration IMUCalibration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
 	lastUpdate := time.Now()
 	// Clean out any old data sat in the port
 	a.Port.Flush()
-	a.cachedRot = QuatIdentity
+	a.setRotation(QuatIdentity)
 	for {
-		// Check if we need to stop
-		if a.stopFlag {
-			a.stopFlag = false
-			a.stoppedFlag = true
+		// Read the serial. If it fails, stop updating, and keep the error so it can be checked with Err
+		p, err := a.parseNextPacket(stop)
+		if err == errStopped {
+			return
+		}
+		if err != nil {
+			a.setErr(err)
 			return
 		}
 
@@ -126,65 +219,48 @@ func (a *RawArduinoRotationSensor) updateInBackground() {
 		dt := thisUpdate.Sub(lastUpdate)
 		lastUpdate = thisUpdate
 
-		// Read the serial
-		p := a.parseNextPacket()
-
-		// Remove the calibration offsets
-		p.accelX -= a.calibration.accelX
-		p.accelY -= a.calibration.accelY
-		p.accelZ -= a.calibration.accelZ
-		p.gyroX -= a.calibration.gyroX
-		p.gyroY -= a.calibration.gyroY
-		p.gyroZ -= a.calibration.gyroZ
-
-		// Copy the current cached rotation so we can do calculations on it
-		orientation := a.cachedRot
-
-		// Calculate update quaternion based on gyro
-		rawGyroVec := NewVector3(p.gyroX, p.gyroY, p.gyroZ)
-		gyroAngle := rawGyroVec.Len()
-		if gyroAngle != 0 {
-			gyroAxis := rawGyroVec.Unit()
-			q := NewQuatAngleAxis(gyroAxis, -gyroAngle*dt.Seconds())
-			orientation = orientation.RotateByLocal(q)
-		}
-
-		// Calculate the vector relative to our current orientation that points at true Up (accel)
-		accelUp := NewVector3(p.accelX, p.accelY, p.accelZ).Unit().Rotated(orientation)
-		orientationUp := Up
+		// Apply the calibration
+		gyro := calibration.ApplyGyro(NewVector3(p.gyroX, p.gyroY, p.gyroZ))
+		accel := calibration.ApplyAccel(NewVector3(p.accelX, p.accelY, p.accelZ))
 
-		// Calculate the quaternion we need to rotate by to move towards our true rotation,  then apply it
-		q := NewQuatFromTo(accelUp, orientationUp)
-		angleMult := accelUp.AngleTo(orientationUp) / 180.0
-		orientation = orientation.RotateByGlobal(NewQuatAngleAxis(NewVector3(q.X, q.Y, q.Z), a.AccSpeed*dt.Seconds()*angleMult))
+		// The arduino's gyro rotates the opposite way to the filter, so reverse it
+		gyro = gyro.Inv()
+		orientation := filter.Update(gyro, accel, dt.Seconds())
 
 		// Copy our new rotation back to the cachedRot
-		a.cachedRot = orientation
+		a.setRotation(orientation)
 	}
 }
 
-// Waits for then reads and parses the next packet sent by arduino. Then converts the packet to spotpuppy coordinate system and reverses gyros is need be
-func (a *RawArduinoRotationSensor) parseNextPacket() rotationPacket {
+// Waits for then reads and parses the next packet sent by arduino. Then converts the packet to spotpuppy coordinate system and reverses gyros is need be.
+// Returns errStopped if stop is closed before a packet arrives, or an error if the serial port could not be read
+func (a *RawArduinoRotationSensor) parseNextPacket(stop <-chan struct{}) (rotationPacket, error) {
+	next := func() (byte, error) {
+		b, err := readByte(a.Port, stop)
+		if err != nil && err != errStopped {
+			err = fmt.Errorf("failed to read from arduino on port %s: %w", a.PortName, err)
+		}
+		return b, err
+	}
 	for {
-		buf := make([]byte, 1)
 		msg := make([]byte, 0)
 		for {
-			_, err := a.Port.Read(buf)
+			b, err := next()
 			if err != nil {
-				panic(err)
+				return rotationPacket{}, err
 			}
-			if buf[0] == '[' {
-				msg = append(msg, buf[0])
+			if b == '[' {
+				msg = append(msg, b)
 				break
 			}
 		}
 		for {
-			_, err := a.Port.Read(buf)
+			b, err := next()
 			if err != nil {
-				panic(err)
+				return rotationPacket{}, err
 			}
-			msg = append(msg, buf[0])
-			if buf[0] == ']' {
+			msg = append(msg, b)
+			if b == ']' {
 				break
 			}
 		}
@@ -209,7 +285,28 @@ func (a *RawArduinoRotationSensor) parseNextPacket() rotationPacket {
 				accelX: accData.X,
 				accelY: accData.Y,
 				accelZ: accData.Z,
-			}
+			}, nil
+		}
+	}
+}
+
+// readByte reads a single byte from a serial port. Reads time out when no data arrives (see serialReadTimeout), so stop is checked regularly while waiting.
+// Returns errStopped if stop is closed before a byte arrives
+func readByte(r io.Reader, stop <-chan struct{}) (byte, error) {
+	buf := make([]byte, 1)
+	for {
+		select {
+		case <-stop:
+			return 0, errStopped
+		default:
+		}
+		n, err := r.Read(buf)
+		if n == 1 {
+			return buf[0], nil
+		}
+		// A read that times out returns io.EOF with no data
+		if err != nil && err != io.EOF {
+			return 0, err
 		}
 	}
 }
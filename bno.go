@@ -0,0 +1,337 @@
+package spotpuppy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/googolgl/go-i2c"
+	"github.com/tarm/serial"
+)
+
+func init() {
+	RegisterRotationSensor("bno", func() RotationSensor { return NewBNORotationSensor(ChipBNO055, InterfaceI2C) })
+}
+
+const ChipBNO055 = "bno055"
+const ChipBNO085 = "bno085"
+
+const InterfaceI2C = "i2c"
+const InterfaceUART = "uart"
+
+// BNOCalibrationStatus is how well calibrated each part of a BNO chip is, from 0 (not calibrated) to 3 (fully calibrated).
+// The BNO055 reports all of them. The BNO085 only reports System, which is the accuracy of its orientation
+type BNOCalibrationStatus struct {
+	System int `json:"system"`
+	Gyro   int `json:"gyro"`
+	Accel  int `json:"accel"`
+	Mag    int `json:"mag"`
+}
+
+// bnoDriver talks to one type of BNO chip over one interface
+type bnoDriver interface {
+	// setup resets and configures the chip, and loads the calibration profile onto it if the sensor has one
+	setup() error
+	// streams is true if the chip sends orientations by itself, so read waits for them instead of being called at the update rate
+	streams() bool
+	// read returns the orientation of the chip in its own axes, and how well calibrated it is. ok is false if the chip has no new orientation.
+	// Drivers that stream return errStopped if stop is closed while waiting
+	read(stop <-chan struct{}) (q Quat, status BNOCalibrationStatus, ok bool, err error)
+	// calibrated returns true if the chip is calibrated enough to save its calibration
+	calibrated(status BNOCalibrationStatus) bool
+	// saveCalibration saves the calibration of the chip. The sensor must not be updating
+	saveCalibration() error
+}
+
+// BNORotationSensor reads the orientation from a BNO055 or BNO085, which fuse their own gyro, accelerometer and magnetometer on the chip, over i2c or uart.
+// The BNO055 uses its normal register interface on both. The BNO085 uses SHTP on i2c, and must be in UART-RVC mode (with the PS0 pin high) on uart
+type BNORotationSensor struct {
+	// Bus is the i2c connection to the chip. If it is nil, Setup connects to Address on Device. It can be set to a fake bus before calling Setup for testing.
+	// A BNO085 also needs the bus to have ReadBytes and WriteBytes methods, like *i2c.Options
+	Bus I2CBus `json:"-"`
+	// Port is the uart connection to the chip. If it is nil, Setup opens PortName. It can be set to a fake port before calling Setup for testing
+	Port    io.ReadWriter `json:"-"`
+	IsReady bool          `json:"-"`
+	// Chip is the type of chip, either ChipBNO055 or ChipBNO085
+	Chip string `json:"chip"`
+	// Interface is how the chip is connected, either InterfaceI2C or InterfaceUART
+	Interface string `json:"interface"`
+	Device    string `json:"i2c_device"`
+	Address   uint8  `json:"i2c_address"`
+	PortName  string `json:"port_name"`
+	// UpdateRate is how many times per second the chip is read. A BNO085 on uart always sends 100 times per second
+	UpdateRate float64 `json:"update_rate"`
+	// UseMagnetometer makes the chip use its magnetometer to find north, so the yaw does not drift. It should be turned off if the motors upset the magnetometer
+	UseMagnetometer bool `json:"use_magnetometer"`
+	// Axes remaps the axes of the chip into spotpuppy space
+	Axes *AxesRemapper `json:"axes_remap"`
+	// Calibration is the calibration profile of a BNO055, which is saved by Calibrate and loaded onto the chip by Setup.
+	// A BNO085 saves its calibration in its own flash instead
+	Calibration *BNO055Calibration `json:"calibration,omitempty"`
+	// CalibrationTimeout is how many seconds Calibrate waits for the chip to calibrate
+	CalibrationTimeout float64 `json:"calibration_timeout"`
+	driver             bnoDriver
+	// ownsBus and ownsPort are true if Bus and Port were opened by Setup, so they should be closed by Close
+	ownsBus  bool
+	ownsPort bool
+	backgroundUpdater
+	// status is shared with the update thread, so it is protected by mu
+	status BNOCalibrationStatus
+}
+
+// Creates a new sensor instance for a chip (ChipBNO055 or ChipBNO085) connected by an interface (InterfaceI2C or InterfaceUART), at the chip's default address on /dev/i2c-1, or on /dev/serial0.
+// Does not connect to the chip yet, that is done from Setup()
+func NewBNORotationSensor(chip, iface string) *BNORotationSensor {
+	b := &BNORotationSensor{
+		IsReady:            false,
+		Chip:               chip,
+		Interface:          iface,
+		Device:             "/dev/i2c-1",
+		Address:            0x28,
+		PortName:           "/dev/serial0",
+		UpdateRate:         100,
+		UseMagnetometer:    true,
+		Axes:               NewAxesRemapper(Forward, Left, Down),
+		CalibrationTimeout: 60,
+	}
+	b.backgroundUpdater = newBackgroundUpdater(b.startUpdating)
+	if chip == ChipBNO085 {
+		b.Address = 0x4A
+	}
+	return b
+}
+
+// Sets up and connects to the chip, loads the calibration, then starts updating in the background. If the sensor was already set up, it is closed first.
+// Returns an error if the chip could not be found, or the settings are not valid
+func (b *BNORotationSensor) Setup() error {
+	b.Close()
+	b.lifecycle.Lock()
+	defer b.lifecycle.Unlock()
+	if b.UpdateRate <= 0 {
+		return errors.New("update rate must be more than 0")
+	}
+	err := b.connect()
+	if err != nil {
+		b.disconnect()
+		return err
+	}
+	err = b.driver.setup()
+	if err != nil {
+		b.disconnect()
+		return err
+	}
+	b.IsReady = true
+	return b.start()
+}
+
+// connect opens the bus or port if they have not been set, and creates the driver for the chip. lifecycle must be held
+func (b *BNORotationSensor) connect() error {
+	switch b.Interface {
+	case InterfaceI2C:
+		if b.Bus == nil {
+			bus, err := i2c.New(b.Address, b.Device)
+			if err != nil {
+				return fmt.Errorf("could not connect to i2c: %w", err)
+			}
+			b.Bus = bus
+			b.ownsBus = true
+		}
+	case InterfaceUART:
+		if b.Port == nil {
+			c := &serial.Config{Name: b.PortName, Baud: 115200, ReadTimeout: serialReadTimeout}
+			port, err := serial.OpenPort(c)
+			if err != nil {
+				return fmt.Errorf("failed to connect to %s on port %s: %w", b.Chip, b.PortName, err)
+			}
+			b.Port = port
+			b.ownsPort = true
+		}
+	default:
+		return fmt.Errorf("unknown interface '%s', expected '%s' or '%s'", b.Interface, InterfaceI2C, InterfaceUART)
+	}
+	switch {
+	case b.Chip == ChipBNO055 && b.Interface == InterfaceI2C:
+		b.driver = &bno055Driver{sensor: b, bus: b.Bus}
+	case b.Chip == ChipBNO055 && b.Interface == InterfaceUART:
+		b.driver = &bno055Driver{sensor: b, bus: &bno055UARTBus{port: b.Port}}
+	case b.Chip == ChipBNO085 && b.Interface == InterfaceI2C:
+		bus, ok := b.Bus.(i2cStream)
+		if !ok {
+			return errors.New("the i2c bus of a BNO085 must have ReadBytes and WriteBytes methods")
+		}
+		b.driver = &bno085Driver{sensor: b, bus: bus}
+	case b.Chip == ChipBNO085 && b.Interface == InterfaceUART:
+		b.driver = &bno085RVCDriver{port: b.Port}
+	default:
+		return fmt.Errorf("unknown chip '%s', expected '%s' or '%s'", b.Chip, ChipBNO055, ChipBNO085)
+	}
+	return nil
+}
+
+// disconnect closes and forgets Bus and Port if they were opened by Setup. A bus or port that was set by the user is left open. lifecycle must be held
+func (b *BNORotationSensor) disconnect() error {
+	var err error
+	if b.ownsBus {
+		if c, ok := b.Bus.(io.Closer); ok {
+			err = c.Close()
+		}
+		b.Bus = nil
+		b.ownsBus = false
+	}
+	if b.ownsPort {
+		if c, ok := b.Port.(io.Closer); ok {
+			err = c.Close()
+		}
+		b.Port = nil
+		b.ownsPort = false
+	}
+	b.driver = nil
+	return err
+}
+
+// Close stops updating, and closes the connection to the chip if it was opened by Setup. Setup must be called again before the sensor can be used
+func (b *BNORotationSensor) Close() error {
+	b.lifecycle.Lock()
+	defer b.lifecycle.Unlock()
+	b.stopAndWait()
+	b.IsReady = false
+	return b.disconnect()
+}
+
+// CalibrationStatus returns how well calibrated the chip was when it was last read. Non blocking
+func (b *BNORotationSensor) CalibrationStatus() BNOCalibrationStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status
+}
+
+// Calibrate waits for the chip to calibrate itself, then saves the calibration. While it waits, the robot should be held still in a few different positions
+// (and, if UseMagnetometer is on, moved in a figure of eight). A BNO055 saves its calibration to Calibration, so save the sensor with SaveRotationSensorToFile afterwards to keep it.
+// A BNO085 on i2c saves its calibration to its own flash. A BNO085 in UART-RVC mode calibrates itself, so this does nothing.
+// The sensor can still be stopped or closed while Calibrate waits, which cancels the calibration.
+// Returns an error if the chip does not calibrate within CalibrationTimeout seconds, or the calibration is cancelled
+func (b *BNORotationSensor) Calibrate() error {
+	b.lifecycle.Lock()
+	if !b.IsReady {
+		b.lifecycle.Unlock()
+		return errors.New("rotation sensor has not been set up")
+	}
+	err := b.start()
+	driver, done, chip := b.driver, b.done, b.Chip
+	timeout := time.Duration(b.CalibrationTimeout * float64(time.Second))
+	b.lifecycle.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Wait without holding lifecycle, so that Stop, Close and Setup do not have to wait for the chip to calibrate
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second / 10)
+	defer ticker.Stop()
+	for !driver.calibrated(b.CalibrationStatus()) {
+		select {
+		case <-done:
+			// The update thread stopped, either because of a read error, or because the sensor was stopped
+			if err := b.Err(); err != nil {
+				return err
+			}
+			return errBNOCalibrationCancelled
+		case <-deadline.C:
+			return fmt.Errorf("timed out waiting for %s to calibrate (%+v)", chip, b.CalibrationStatus())
+		case <-ticker.C:
+		}
+	}
+
+	b.lifecycle.Lock()
+	defer b.lifecycle.Unlock()
+	// If the sensor was stopped, restarted or closed since we checked, the calibration might not be from this chip any more
+	if b.done != done {
+		return errBNOCalibrationCancelled
+	}
+	b.stopAndWait()
+	err = b.driver.saveCalibration()
+	if err != nil {
+		b.setErr(err)
+		return err
+	}
+
+	// Restart update in background
+	return b.start()
+}
+
+// errBNOCalibrationCancelled is returned by Calibrate when the sensor is stopped while it waits
+var errBNOCalibrationCancelled = errors.New("calibration was cancelled because the rotation sensor was stopped")
+
+// startUpdating starts the update thread with the driver for the chip. lifecycle must be held
+func (b *BNORotationSensor) startUpdating(stop <-chan struct{}, done chan<- struct{}) error {
+	if !b.IsReady {
+		return errors.New("rotation sensor has not been set up")
+	}
+	go b.updateInBackground(b.driver, stop, done)
+	return nil
+}
+
+// This reads the chip in the background so that the update loop always gets the most up to date info without having to wait.
+// It stops when stop is closed, or when the chip cannot be read, and closes done when it has stopped
+func (b *BNORotationSensor) updateInBackground(driver bnoDriver, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	var tick <-chan time.Time
+	if !driver.streams() {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / b.UpdateRate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	b.mu.Lock()
+	b.status = BNOCalibrationStatus{}
+	b.mu.Unlock()
+	for {
+		if tick != nil {
+			select {
+			case <-stop:
+				return
+			case <-tick:
+			}
+		}
+		// Read the chip. If it fails, stop updating, and keep the error so it can be checked with Err
+		q, status, ok, err := driver.read(stop)
+		if err == errStopped {
+			return
+		}
+		if err != nil {
+			b.setErr(err)
+			return
+		}
+		if !ok {
+			continue
+		}
+
+		// Copy our new rotation back to the cachedRot
+		b.mu.Lock()
+		b.cachedRot = b.Axes.RemapQuat(q).Unit()
+		b.status = status
+		b.mu.Unlock()
+	}
+}
+
+// bnoJSON has the same fields as BNORotationSensor, but none of its methods
+type bnoJSON BNORotationSensor
+
+// UnmarshalJSON loads the sensor. If the file does not set the address, the default address of the chip is used
+func (b *BNORotationSensor) UnmarshalJSON(data []byte) error {
+	err := json.Unmarshal(data, (*bnoJSON)(b))
+	if err != nil {
+		return err
+	}
+	fields := make(map[string]json.RawMessage)
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	if _, ok := fields["i2c_address"]; !ok {
+		b.Address = NewBNORotationSensor(b.Chip, b.Interface).Address
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package spotpuppy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Registers of the BNO055 (on page 0)
+const (
+	bno055RegChipID      = 0x00
+	bno055RegPageID      = 0x07
+	bno055RegQuaternion  = 0x20
+	bno055RegCalibStat   = 0x35
+	bno055RegOprMode     = 0x3D
+	bno055RegPwrMode     = 0x3E
+	bno055RegCalibration = 0x55
+)
+
+// Operating modes of the BNO055
+const (
+	bno055ModeConfig = 0x00
+	bno055ModeIMU    = 0x08
+	bno055ModeNDOF   = 0x0C
+)
+
+// bno055ChipID is the value of the chip id register of every BNO055
+const bno055ChipID = 0xA0
+
+// bno055ModeSwitchTime is how long the BNO055 takes to change operating mode
+const bno055ModeSwitchTime = 25 * time.Millisecond
+
+// bno055BootTime is how long the BNO055 can take to respond after it is powered on
+const bno055BootTime = time.Second
+
+// BNO055Calibration is the calibration profile of a BNO055, in the chip's own units. It can be read from a calibrated chip, then written back when it starts, so it does not need to calibrate again
+type BNO055Calibration struct {
+	AccelOffset [3]int16 `json:"accel_offset"`
+	MagOffset   [3]int16 `json:"mag_offset"`
+	GyroOffset  [3]int16 `json:"gyro_offset"`
+	AccelRadius int16    `json:"accel_radius"`
+	MagRadius   int16    `json:"mag_radius"`
+}
+
+// bno055CalibrationSize is the number of bytes in the calibration registers
+const bno055CalibrationSize = 22
+
+// bytes returns the calibration in the layout of the calibration registers
+func (c *BNO055Calibration) bytes() []byte {
+	values := make([]int16, 0, bno055CalibrationSize/2)
+	values = append(values, c.AccelOffset[:]...)
+	values = append(values, c.MagOffset[:]...)
+	values = append(values, c.GyroOffset[:]...)
+	values = append(values, c.AccelRadius, c.MagRadius)
+	buf := make([]byte, bno055CalibrationSize)
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(v))
+	}
+	return buf
+}
+
+// parseBNO055Calibration reads a calibration from the layout of the calibration registers
+func parseBNO055Calibration(buf []byte) *BNO055Calibration {
+	value := func(i int) int16 {
+		return int16(binary.LittleEndian.Uint16(buf[i*2:]))
+	}
+	c := &BNO055Calibration{}
+	for i := 0; i < 3; i++ {
+		c.AccelOffset[i] = value(i)
+		c.MagOffset[i] = value(i + 3)
+		c.GyroOffset[i] = value(i + 6)
+	}
+	c.AccelRadius = value(9)
+	c.MagRadius = value(10)
+	return c
+}
+
+// bno055Driver reads a BNO055 through its registers
+type bno055Driver struct {
+	sensor *BNORotationSensor
+	bus    I2CBus
+}
+
+func (d *bno055Driver) streams() bool {
+	return false
+}
+
+// setup checks the chip is a BNO055, loads the calibration profile if there is one, and starts fusing
+func (d *bno055Driver) setup() error {
+	err := d.checkChipID()
+	if err != nil {
+		return err
+	}
+	err = d.setMode(bno055ModeConfig)
+	if err != nil {
+		return err
+	}
+	err = d.write(bno055RegPageID, 0)
+	if err != nil {
+		return err
+	}
+	err = d.write(bno055RegPwrMode, 0)
+	if err != nil {
+		return err
+	}
+	if d.sensor.Calibration != nil {
+		for i, v := range d.sensor.Calibration.bytes() {
+			err = d.write(bno055RegCalibration+byte(i), v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return d.setMode(d.fusionMode())
+}
+
+// checkChipID waits for the chip to boot, and checks that it is a BNO055
+func (d *bno055Driver) checkChipID() error {
+	deadline := time.Now().Add(bno055BootTime)
+	for {
+		id, _, err := d.bus.ReadRegBytes(bno055RegChipID, 1)
+		if err == nil && len(id) == 1 {
+			if id[0] != bno055ChipID {
+				return fmt.Errorf("device is not a BNO055 (chip id is 0x%x)", id[0])
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("could not find BNO055: %v", err)
+		}
+		time.Sleep(bno055BootTime / 10)
+	}
+}
+
+// fusionMode returns the operating mode that fuses the sensors that are turned on
+func (d *bno055Driver) fusionMode() byte {
+	if d.sensor.UseMagnetometer {
+		return bno055ModeNDOF
+	}
+	return bno055ModeIMU
+}
+
+// setMode changes the operating mode, and waits for the chip to switch
+func (d *bno055Driver) setMode(mode byte) error {
+	err := d.write(bno055RegOprMode, mode)
+	if err != nil {
+		return err
+	}
+	time.Sleep(bno055ModeSwitchTime)
+	return nil
+}
+
+// write writes a single register
+func (d *bno055Driver) write(reg, value byte) error {
+	err := d.bus.WriteRegU8(reg, value)
+	if err != nil {
+		return fmt.Errorf("failed to write to BNO055: %w", err)
+	}
+	return nil
+}
+
+// read reads the quaternion, and the calibration status which is a few registers after it
+func (d *bno055Driver) read(stop <-chan struct{}) (Quat, BNOCalibrationStatus, bool, error) {
+	n := bno055RegCalibStat - bno055RegQuaternion + 1
+	buf, _, err := d.bus.ReadRegBytes(bno055RegQuaternion, n)
+	if err != nil {
+		return Quat{}, BNOCalibrationStatus{}, false, fmt.Errorf("failed to read from BNO055: %w", err)
+	}
+	if len(buf) != n {
+		return Quat{}, BNOCalibrationStatus{}, false, fmt.Errorf("failed to read from BNO055: expected %d bytes but got %d", n, len(buf))
+	}
+	value := func(i int) float64 {
+		return float64(int16(binary.LittleEndian.Uint16(buf[i*2:]))) / (1 << 14)
+	}
+	q := NewQuat(value(0), value(1), value(2), value(3))
+	c := buf[n-1]
+	status := BNOCalibrationStatus{
+		System: int(c>>6) & 3,
+		Gyro:   int(c>>4) & 3,
+		Accel:  int(c>>2) & 3,
+		Mag:    int(c) & 3,
+	}
+	// The quaternion is all zeros until the chip has started fusing
+	return q, status, q.Norm2() > 0, nil
+}
+
+// calibrated is true when the gyro, accelerometer and (if it is used) magnetometer are fully calibrated
+func (d *bno055Driver) calibrated(status BNOCalibrationStatus) bool {
+	return status.Gyro == 3 && status.Accel == 3 && (status.Mag == 3 || !d.sensor.UseMagnetometer)
+}
+
+// saveCalibration reads the calibration profile into the sensor's Calibration. The chip must be in config mode to read it
+func (d *bno055Driver) saveCalibration() error {
+	err := d.setMode(bno055ModeConfig)
+	if err != nil {
+		return err
+	}
+	buf, _, err := d.bus.ReadRegBytes(bno055RegCalibration, bno055CalibrationSize)
+	if err != nil {
+		return fmt.Errorf("failed to read calibration from BNO055: %w", err)
+	}
+	if len(buf) != bno055CalibrationSize {
+		return fmt.Errorf("failed to read calibration from BNO055: expected %d bytes but got %d", bno055CalibrationSize, len(buf))
+	}
+	d.sensor.Calibration = parseBNO055Calibration(buf)
+	return d.setMode(d.fusionMode())
+}
+
+// bno055UARTBus reads and writes the registers of a BNO055 over its uart protocol
+type bno055UARTBus struct {
+	port io.ReadWriter
+}
+
+// bno055UARTRetries is how many times a uart command is sent before giving up, as the BNO055 sometimes drops commands when it is busy
+const bno055UARTRetries = 5
+
+// Bytes of the BNO055 uart protocol
+const (
+	bno055UARTStart   = 0xAA
+	bno055UARTWrite   = 0x00
+	bno055UARTRead    = 0x01
+	bno055UARTReadOK  = 0xBB
+	bno055UARTStatus  = 0xEE
+	bno055UARTWriteOK = 0x01
+)
+
+// ReadRegBytes reads n registers, starting at reg
+func (u *bno055UARTBus) ReadRegBytes(reg byte, n int) ([]byte, int, error) {
+	var err error
+	for i := 0; i < bno055UARTRetries; i++ {
+		var buf []byte
+		buf, err = u.readOnce(reg, n)
+		if err == nil {
+			return buf, len(buf), nil
+		}
+	}
+	return nil, 0, err
+}
+
+// WriteRegU8 writes a single register
+func (u *bno055UARTBus) WriteRegU8(reg byte, value byte) error {
+	var err error
+	for i := 0; i < bno055UARTRetries; i++ {
+		err = u.writeOnce(reg, value)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (u *bno055UARTBus) readOnce(reg byte, n int) ([]byte, error) {
+	_, err := u.port.Write([]byte{bno055UARTStart, bno055UARTRead, reg, byte(n)})
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 2)
+	_, err = io.ReadFull(u.port, header)
+	if err != nil {
+		return nil, fmt.Errorf("no response from BNO055: %w", err)
+	}
+	if header[0] == bno055UARTStatus {
+		return nil, fmt.Errorf("BNO055 could not read register 0x%x (status 0x%x)", reg, header[1])
+	}
+	if header[0] != bno055UARTReadOK || int(header[1]) != n {
+		return nil, errors.New("unexpected response from BNO055")
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(u.port, buf)
+	if err != nil {
+		return nil, fmt.Errorf("no response from BNO055: %w", err)
+	}
+	return buf, nil
+}
+
+func (u *bno055UARTBus) writeOnce(reg, value byte) error {
+	_, err := u.port.Write([]byte{bno055UARTStart, bno055UARTWrite, reg, 1, value})
+	if err != nil {
+		return err
+	}
+	response := make([]byte, 2)
+	_, err = io.ReadFull(u.port, response)
+	if err != nil {
+		return fmt.Errorf("no response from BNO055: %w", err)
+	}
+	if response[0] != bno055UARTStatus || response[1] != bno055UARTWriteOK {
+		return fmt.Errorf("BNO055 could not write register 0x%x (status 0x%x)", reg, response[1])
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package spotpuppy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// i2cStream is an i2c connection that can read and write raw bytes, rather than registers. It is implemented by *i2c.Options from github.com/googolgl/go-i2c
+type i2cStream interface {
+	ReadBytes(buf []byte) (int, error)
+	WriteBytes(buf []byte) (int, error)
+}
+
+// SHTP channels of the BNO085
+const (
+	shtpChannelExecutable = 1
+	shtpChannelControl    = 2
+	shtpChannelReports    = 3
+)
+
+// SHTP report ids of the BNO085
+const (
+	shtpReportRotationVector     = 0x05
+	shtpReportGameRotationVector = 0x08
+	shtpReportTimestampRebase    = 0xFA
+	shtpReportBaseTimestamp      = 0xFB
+	shtpReportCommandRequest     = 0xF2
+	shtpReportSetFeature         = 0xFD
+)
+
+// SHTP commands of the BNO085
+const (
+	shtpCommandSaveDCD          = 0x06
+	shtpCommandConfigureMECalib = 0x07
+)
+
+// shtpMaxPacket is the largest packet that is read from the BNO085. Larger packets are only sent when the chip starts, and are skipped
+const shtpMaxPacket = 512
+
+// bno085ResetTime is how long the BNO085 takes to restart after a reset
+const bno085ResetTime = 300 * time.Millisecond
+
+// bno085Driver reads a BNO085 over i2c with SHTP (the sensor hub transport protocol)
+type bno085Driver struct {
+	sensor *BNORotationSensor
+	bus    i2cStream
+	// sequence is the sequence number of the next packet on each channel
+	sequence [6]byte
+	// commandSequence is the sequence number of the next command
+	commandSequence byte
+}
+
+func (d *bno085Driver) streams() bool {
+	return false
+}
+
+// setup resets the chip, turns on its dynamic calibration, and asks it to send rotation vectors at the update rate
+func (d *bno085Driver) setup() error {
+	err := d.send(shtpChannelExecutable, []byte{1})
+	if err != nil {
+		return err
+	}
+	time.Sleep(bno085ResetTime)
+	// Throw away the messages the chip sends when it starts
+	for i := 0; i < 20; i++ {
+		_, _, err := d.receive()
+		if err != nil {
+			return err
+		}
+	}
+	mag := byte(0)
+	if d.sensor.UseMagnetometer {
+		mag = 1
+	}
+	err = d.command(shtpCommandConfigureMECalib, 1, 1, mag)
+	if err != nil {
+		return err
+	}
+	report := byte(shtpReportGameRotationVector)
+	if d.sensor.UseMagnetometer {
+		report = shtpReportRotationVector
+	}
+	feature := make([]byte, 17)
+	feature[0] = shtpReportSetFeature
+	feature[1] = report
+	binary.LittleEndian.PutUint32(feature[5:], uint32(1e6/d.sensor.UpdateRate))
+	return d.send(shtpChannelControl, feature)
+}
+
+// read reads packets until there are none left, and returns the newest rotation vector
+func (d *bno085Driver) read(stop <-chan struct{}) (Quat, BNOCalibrationStatus, bool, error) {
+	var q Quat
+	var status BNOCalibrationStatus
+	found := false
+	for i := 0; i < 10; i++ {
+		channel, payload, err := d.receive()
+		if err != nil {
+			return Quat{}, BNOCalibrationStatus{}, false, err
+		}
+		if payload == nil {
+			break
+		}
+		if channel != shtpChannelReports {
+			continue
+		}
+		if q1, s1, ok := parseSHTPRotation(payload); ok {
+			q, status, found = q1, s1, true
+		}
+	}
+	return q, status, found, nil
+}
+
+// parseSHTPRotation finds the last rotation vector in a packet of sensor reports
+func parseSHTPRotation(payload []byte) (Quat, BNOCalibrationStatus, bool) {
+	var q Quat
+	var status BNOCalibrationStatus
+	found := false
+	for len(payload) > 0 {
+		size := 0
+		switch payload[0] {
+		case shtpReportBaseTimestamp, shtpReportTimestampRebase:
+			size = 5
+		case shtpReportRotationVector:
+			size = 14
+		case shtpReportGameRotationVector:
+			size = 12
+		default:
+			// We cannot tell how long an unknown report is, so skip the rest of the packet
+			return q, status, found
+		}
+		if len(payload) < size {
+			return q, status, found
+		}
+		if payload[0] == shtpReportRotationVector || payload[0] == shtpReportGameRotationVector {
+			value := func(i int) float64 {
+				return float64(int16(binary.LittleEndian.Uint16(payload[4+i*2:]))) / (1 << 14)
+			}
+			q = NewQuat(value(3), value(0), value(1), value(2))
+			status = BNOCalibrationStatus{System: int(payload[2]) & 3}
+			found = true
+		}
+		payload = payload[size:]
+	}
+	return q, status, found
+}
+
+// calibrated is true when the chip is confident in its rotation vector
+func (d *bno085Driver) calibrated(status BNOCalibrationStatus) bool {
+	return status.System == 3
+}
+
+// saveCalibration tells the chip to save its calibration (its dynamic calibration data) to its own flash
+func (d *bno085Driver) saveCalibration() error {
+	return d.command(shtpCommandSaveDCD)
+}
+
+// command sends a command with up to 9 parameters
+func (d *bno085Driver) command(cmd byte, params ...byte) error {
+	payload := make([]byte, 12)
+	payload[0] = shtpReportCommandRequest
+	payload[1] = d.commandSequence
+	payload[2] = cmd
+	copy(payload[3:], params)
+	d.commandSequence++
+	return d.send(shtpChannelControl, payload)
+}
+
+// send sends a packet on a channel
+func (d *bno085Driver) send(channel byte, payload []byte) error {
+	packet := make([]byte, 4+len(payload))
+	binary.LittleEndian.PutUint16(packet, uint16(len(packet)))
+	packet[2] = channel
+	packet[3] = d.sequence[channel]
+	copy(packet[4:], payload)
+	d.sequence[channel]++
+	_, err := d.bus.WriteBytes(packet)
+	if err != nil {
+		return fmt.Errorf("failed to write to BNO085: %w", err)
+	}
+	return nil
+}
+
+// receive reads the next packet. The payload is nil if the chip has nothing to send, or the packet was too large to read
+func (d *bno085Driver) receive() (byte, []byte, error) {
+	// Each read starts with the header of the packet, so read the header to find the length, then read the whole packet
+	header := make([]byte, 4)
+	_, err := d.bus.ReadBytes(header)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read from BNO085: %w", err)
+	}
+	length := int(binary.LittleEndian.Uint16(header))
+	// The top bit is set on the rest of a packet that was too large to read at once
+	if length&0x8000 != 0 || length <= 4 || length > shtpMaxPacket {
+		return 0, nil, nil
+	}
+	packet := make([]byte, length)
+	_, err = d.bus.ReadBytes(packet)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read from BNO085: %w", err)
+	}
+	return packet[2], packet[4:], nil
+}
+
+// bno085RVCDriver reads a BNO085 in UART-RVC mode, where it sends its yaw, pitch and roll 100 times per second without being asked
+type bno085RVCDriver struct {
+	port io.Reader
+	// buf holds the bytes that have been read but are not part of a frame yet
+	buf []byte
+}
+
+// bno085RVCFrameSize is the number of bytes in each UART-RVC frame, including the two header bytes
+const bno085RVCFrameSize = 19
+
+func (d *bno085RVCDriver) streams() bool {
+	return true
+}
+
+// setup does nothing, as the chip starts sending by itself
+func (d *bno085RVCDriver) setup() error {
+	return nil
+}
+
+// read waits for the next frame with a correct checksum
+func (d *bno085RVCDriver) read(stop <-chan struct{}) (Quat, BNOCalibrationStatus, bool, error) {
+	for {
+		for len(d.buf) < bno085RVCFrameSize {
+			b, err := readByte(d.port, stop)
+			if err == errStopped {
+				return Quat{}, BNOCalibrationStatus{}, false, err
+			}
+			if err != nil {
+				return Quat{}, BNOCalibrationStatus{}, false, fmt.Errorf("failed to read from BNO085: %w", err)
+			}
+			d.buf = append(d.buf, b)
+		}
+		// Each frame starts with 0xAA 0xAA, and ends with the sum of the bytes in between. If this is not a frame, try again one byte later
+		frame := d.buf[:bno085RVCFrameSize]
+		sum := byte(0)
+		for _, b := range frame[2 : bno085RVCFrameSize-1] {
+			sum += b
+		}
+		if frame[0] != 0xAA || frame[1] != 0xAA || sum != frame[bno085RVCFrameSize-1] {
+			d.buf = d.buf[1:]
+			continue
+		}
+		d.buf = d.buf[bno085RVCFrameSize:]
+		// The frame has an index, then yaw, pitch and roll in hundredths of a degree, then the accelerometer, which is not needed
+		angle := func(i int) float64 {
+			return float64(int16(binary.LittleEndian.Uint16(frame[3+i*2:]))) / 100
+		}
+		yaw := NewQuatAngleAxis(NewVector3(0, 0, 1), angle(0))
+		pitch := NewQuatAngleAxis(NewVector3(0, 1, 0), angle(1))
+		roll := NewQuatAngleAxis(NewVector3(1, 0, 0), angle(2))
+		return yaw.Prod(pitch).Prod(roll), BNOCalibrationStatus{}, true, nil
+	}
+}
+
+// calibrated is always true, as the chip calibrates itself in UART-RVC mode
+func (d *bno085RVCDriver) calibrated(status BNOCalibrationStatus) bool {
+	return true
+}
+
+// saveCalibration does nothing, as the calibration cannot be saved in UART-RVC mode
+func (d *bno085RVCDriver) saveCalibration() error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package spotpuppy
+
+// BodyPose is the position and rotation of the body of a robot, relative to the point where the body would be if it was level
+type BodyPose struct {
+	Position Vec3 `json:"position"`
+	Rotation Quat `json:"rotation"`
+}
+
+// NewBodyPose creates a new BodyPose from a position and a rotation
+func NewBodyPose(position Vec3, rotation Quat) BodyPose {
+	return BodyPose{
+		Position: position,
+		Rotation: rotation,
+	}
+}
+
+// rotation returns the rotation of this pose. A zero rotation (for example from json with no rotation) is treated as no rotation
+func (b BodyPose) rotation() Quat {
+	if b.Rotation == (Quat{}) {
+		return QuatIdentity
+	}
+	return b.Rotation
+}
+
+// SetBodyPose sets the pose of the body for the next update call. Feet set with SetFootPosition will stay in the same place while the body moves to this pose.
+// It does not perform any calculations or movement immediately
+func (q *LeggedRobot) SetBodyPose(pose BodyPose) {
+	pose.Rotation = pose.rotation()
+	q.bodyPose = pose
+}
+
+// GetBodyPose returns the pose of the body set with SetBodyPose
+func (q *LeggedRobot) GetBodyPose() BodyPose {
+	return q.bodyPose
+}
+
+// SetFootPosition sets a foot position for the next update call. It does not perform any calculations or movement immediately.
+// Unlike SetLegPosition, the position is in world space, relative to the center of the body when it has no body pose (see SetBodyPose).
+// On each update, the position of the foot relative to its shoulder is calculated using the body pose at that time
+func (q *LeggedRobot) SetFootPosition(leg string, pos Vec3) {
+	q.cachedFootPositions[leg] = pos
+}
+
+// GetFootPosition returns the position that the foot will be moved to on the next update call, in the same space as SetFootPosition.
+// If the leg was set with SetLegPosition, this uses the current body pose
+func (q *LeggedRobot) GetFootPosition(leg string) Vec3 {
+	if foot, ok := q.cachedFootPositions[leg]; ok {
+		return foot
+	}
+	return q.legToFoot(leg, q.cachedLegPositions[leg])
+}
+
+// footToLeg converts a foot position in world space to a position relative to the shoulder of the leg, using the current body pose
+func (q *LeggedRobot) footToLeg(leg string, foot Vec3) Vec3 {
+	bodySpace := foot.Sub(q.bodyPose.Position).Rotated(q.bodyPose.Rotation.Inv())
+	return q.BodyToLeg(leg, bodySpace)
+}
+
+// legToFoot converts a position relative to the shoulder of the leg to a foot position in world space, using the current body pose
+func (q *LeggedRobot) legToFoot(leg string, pos Vec3) Vec3 {
+	bodySpace := q.LegToBody(leg, pos)
+	return bodySpace.Rotated(q.bodyPose.Rotation).Add(q.bodyPose.Position)
+}
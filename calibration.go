@@ -0,0 +1,191 @@
+package spotpuppy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// IMUCalibration is the calibration of an accelerometer and gyro, in spotpuppy space. It is saved with the rotation sensor, so it only needs to be found once
+type IMUCalibration struct {
+	// AccelOffset is taken away from each accelerometer reading
+	AccelOffset Vec3 `json:"accel_offset"`
+	// AccelScale multiplies each axis of the accelerometer reading after AccelOffset is taken away, so that it reads 1 when still. An axis that is 0 is not scaled
+	AccelScale Vec3 `json:"accel_scale"`
+	// GyroBias is taken away from each gyro reading
+	GyroBias Vec3 `json:"gyro_bias"`
+}
+
+// ApplyAccel returns a raw accelerometer reading with the calibration applied
+func (c IMUCalibration) ApplyAccel(raw Vec3) Vec3 {
+	scale := c.AccelScale
+	for _, s := range []*float64{&scale.X, &scale.Y, &scale.Z} {
+		if *s == 0 {
+			*s = 1
+		}
+	}
+	return raw.Sub(c.AccelOffset).MulVec(scale)
+}
+
+// ApplyGyro returns a raw gyro reading with the calibration applied
+func (c IMUCalibration) ApplyGyro(raw Vec3) Vec3 {
+	return raw.Sub(c.GyroBias)
+}
+
+// CalibrationPosition is a position that the robot is held still in while calibrating the accelerometer
+type CalibrationPosition struct {
+	// Name is a short name for the position
+	Name string
+	// Description tells the user how to place the robot
+	Description string
+	// Up is the direction, in the space of the robot, that points up in this position
+	Up Vec3
+}
+
+// SixPositions are the positions used by six position calibration. Each axis of the robot points straight up in one of them, and straight down in another
+var SixPositions = []CalibrationPosition{
+	{"flat", "Stand the robot flat on its feet", Up},
+	{"upside_down", "Turn the robot upside down", Down},
+	{"nose_up", "Stand the robot on its back end, with its front pointing up", Forward},
+	{"nose_down", "Stand the robot on its front end, with its back pointing up", Backward},
+	{"left_up", "Lie the robot on its right side, with its left side pointing up", Left},
+	{"right_up", "Lie the robot on its left side, with its right side pointing up", Right},
+}
+
+// calibrationSamples is the number of readings taken in each position
+const calibrationSamples = 100
+
+// calibrationPositionTolerance is how many degrees the accelerometer can be from the expected direction in each position, before calibration decides the robot is in the wrong position
+const calibrationPositionTolerance = 45
+
+// calibrationStillness is how far (as a fraction of gravity) an accelerometer reading can be from the average of its position, before calibration decides the robot moved
+const calibrationStillness = 0.1
+
+// calibrateStill measures the gyro bias with the robot held still, and returns c with the new bias. sample is called to read the raw gyro and accelerometer.
+// If c has no six position accelerometer calibration (AccelScale is 0), the robot must also be flat, as the accelerometer offset is set so that it reads gravity,
+// which is what the accelerometer reads when flat and still
+func calibrateStill(c IMUCalibration, gravity Vec3, sample func() (Vec3, Vec3, error)) (IMUCalibration, error) {
+	gyroSum, accelSum := Zero, Zero
+	for i := 0; i < calibrationSamples; i++ {
+		gyro, accel, err := sample()
+		if err != nil {
+			return c, err
+		}
+		gyroSum = gyroSum.Add(gyro)
+		accelSum = accelSum.Add(accel)
+	}
+	c.GyroBias = gyroSum.Mul(1.0 / calibrationSamples)
+	if c.AccelScale == Zero {
+		c.AccelOffset = accelSum.Mul(1.0 / calibrationSamples).Sub(gravity)
+	}
+	return c, nil
+}
+
+// calibrateSixPosition guides the robot through SixPositions, and finds the calibration that fits the readings.
+// Before each position, ready is called, which should return once the robot is still in that position. sample is then called to read the raw gyro and accelerometer.
+// The positions do not need to be exactly level, as the accelerometer is fitted to read 1 in every direction
+func calibrateSixPosition(ready func(CalibrationPosition) error, sample func() (Vec3, Vec3, error)) (IMUCalibration, error) {
+	gyroSum := Zero
+	accels := make([]Vec3, 0, len(SixPositions))
+	for _, pos := range SixPositions {
+		err := ready(pos)
+		if err != nil {
+			return IMUCalibration{}, err
+		}
+		readings := make([]Vec3, calibrationSamples)
+		accelSum := Zero
+		for i := range readings {
+			gyro, accel, err := sample()
+			if err != nil {
+				return IMUCalibration{}, err
+			}
+			gyroSum = gyroSum.Add(gyro)
+			accelSum = accelSum.Add(accel)
+			readings[i] = accel
+		}
+		mean := accelSum.Mul(1.0 / calibrationSamples)
+		for _, r := range readings {
+			if r.Sub(mean).Len() > calibrationStillness*mean.Len() {
+				return IMUCalibration{}, fmt.Errorf("the robot moved while calibrating position '%s'", pos.Name)
+			}
+		}
+		if mean.AngleTo(pos.Up) > calibrationPositionTolerance {
+			return IMUCalibration{}, fmt.Errorf("the robot was not in position '%s' (%s)", pos.Name, pos.Description)
+		}
+		accels = append(accels, mean)
+	}
+	center, radii, ok := fitEllipsoid(accels)
+	if !ok {
+		return IMUCalibration{}, errors.New("could not fit the accelerometer readings")
+	}
+	return IMUCalibration{
+		AccelOffset: center,
+		AccelScale:  NewVector3(1/radii.X, 1/radii.Y, 1/radii.Z),
+		GyroBias:    gyroSum.Mul(1.0 / float64(len(SixPositions)*calibrationSamples)),
+	}, nil
+}
+
+// fitEllipsoid fits a stretched sphere (aligned with the axes) to some points with least squares. It returns the center, and the radius along each axis.
+// ok is false if the points do not cover enough directions
+func fitEllipsoid(points []Vec3) (Vec3, Vec3, bool) {
+	if len(points) < 6 {
+		return Zero, Zero, false
+	}
+	// Each point should fit a*x^2 + b*y^2 + c*z^2 + d*x + e*y + f*z = 1
+	ata := make([][]float64, 6)
+	for i := range ata {
+		ata[i] = make([]float64, 6)
+	}
+	atb := make([]float64, 6)
+	for _, s := range points {
+		row := []float64{s.X * s.X, s.Y * s.Y, s.Z * s.Z, s.X, s.Y, s.Z}
+		for i := range row {
+			for j := range row {
+				ata[i][j] += row[i] * row[j]
+			}
+			atb[i] += row[i]
+		}
+	}
+	p, ok := solveLinear(ata, atb)
+	if !ok || p[0] <= 0 || p[1] <= 0 || p[2] <= 0 {
+		return Zero, Zero, false
+	}
+	center := NewVector3(-p[3]/(2*p[0]), -p[4]/(2*p[1]), -p[5]/(2*p[2]))
+	g := 1 + p[0]*center.X*center.X + p[1]*center.Y*center.Y + p[2]*center.Z*center.Z
+	return center, NewVector3(math.Sqrt(g/p[0]), math.Sqrt(g/p[1]), math.Sqrt(g/p[2])), true
+}
+
+// solveLinear solves a * x = b with gaussian elimination. a and b are changed. ok is false if a has no inverse
+func solveLinear(a [][]float64, b []float64) ([]float64, bool) {
+	n := len(b)
+	for col := 0; col < n; col++ {
+		// Use the row with the largest value in this column, to keep the rounding errors small
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for row := col + 1; row < n; row++ {
+			f := a[row][col] / a[col][col]
+			for k := col; k < n; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+			b[row] -= f * b[col]
+		}
+	}
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := b[row]
+		for k := row + 1; k < n; k++ {
+			sum -= a[row][k] * x[k]
+		}
+		x[row] = sum / a[row][row]
+	}
+	return x, true
+}
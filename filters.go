@@ -0,0 +1,140 @@
+package spotpuppy
+
+func init() {
+	RegisterOrientationFilter("complementary", func() OrientationFilter { return NewComplementaryFilter() })
+	RegisterOrientationFilter("madgwick", func() OrientationFilter { return NewMadgwickFilter() })
+	RegisterOrientationFilter("mahony", func() OrientationFilter { return NewMahonyFilter() })
+}
+
+// OrientationFilter fuses readings from a gyro and an accelerometer into an orientation.
+// Filters that only use a gyro and an accelerometer cannot tell which way is north, so their yaw will drift
+type OrientationFilter interface {
+	// Update takes the angular velocity measured by the gyro (in degrees per second, in the space of the sensor, with positive rotations anticlockwise when looking back along each axis),
+	// the acceleration measured by the accelerometer (in any units, in the space of the sensor, pointing up when the sensor is still),
+	// and the time in seconds since the last update. It returns the new orientation of the sensor in global space
+	Update(gyro, accel Vec3, dt float64) Quat
+	// Reset sets the orientation back to QuatIdentity, and forgets anything else the filter has learned
+	Reset()
+}
+
+// ComplementaryFilter integrates the gyro, then turns the orientation towards the accelerometer at a speed proportional to how far apart they are
+type ComplementaryFilter struct {
+	// Maximum number of deg/s the accelerometer can move the rotation
+	AccSpeed    float64 `json:"acc_speed"`
+	orientation Quat
+}
+
+// NewComplementaryFilter creates a new complementary filter
+func NewComplementaryFilter() *ComplementaryFilter {
+	return &ComplementaryFilter{
+		AccSpeed:    180,
+		orientation: QuatIdentity,
+	}
+}
+
+// Update integrates the gyro, then corrects the orientation with the accelerometer
+func (c *ComplementaryFilter) Update(gyro, accel Vec3, dt float64) Quat {
+	orientation := integrateGyro(c.orientation, gyro, dt)
+	if accel.Len() != 0 {
+		// Calculate the vector relative to our current orientation that points at true Up (accel)
+		accelUp := accel.Unit().Rotated(orientation)
+		// Calculate the quaternion we need to rotate by to move towards our true rotation, then apply it
+		q := NewQuatFromTo(accelUp, Up)
+		angleMult := accelUp.AngleTo(Up) / 180.0
+		orientation = orientation.RotateByGlobal(NewQuatAngleAxis(NewVector3(q.X, q.Y, q.Z), c.AccSpeed*dt*angleMult))
+	}
+	c.orientation = orientation.Unit()
+	return c.orientation
+}
+
+// Reset sets the orientation back to QuatIdentity
+func (c *ComplementaryFilter) Reset() {
+	c.orientation = QuatIdentity
+}
+
+// MadgwickFilter is the gyro and accelerometer version of Sebastian Madgwick's gradient descent filter.
+// Each update, the orientation is turned towards the accelerometer at a fixed rate (set by Beta) as well as being turned by the gyro
+type MadgwickFilter struct {
+	// Beta is the gain of the filter, in radians per second. Larger values trust the accelerometer more, and correct drift faster but are noisier
+	Beta        float64 `json:"beta"`
+	orientation Quat
+}
+
+// NewMadgwickFilter creates a new Madgwick filter with a beta of 0.1
+func NewMadgwickFilter() *MadgwickFilter {
+	return &MadgwickFilter{
+		Beta:        0.1,
+		orientation: QuatIdentity,
+	}
+}
+
+// Update integrates the gyro, plus a step along the normalised gradient towards the accelerometer
+func (m *MadgwickFilter) Update(gyro, accel Vec3, dt float64) Quat {
+	if e, ok := accelError(m.orientation, accel); ok && e.Len() != 0 {
+		// The gradient step moves the quaternion by Beta, which turns the orientation at twice that rate
+		gyro = gyro.Add(e.Unit().Mul(Degrees(2 * m.Beta)))
+	}
+	m.orientation = integrateGyro(m.orientation, gyro, dt)
+	return m.orientation
+}
+
+// Reset sets the orientation back to QuatIdentity
+func (m *MadgwickFilter) Reset() {
+	m.orientation = QuatIdentity
+}
+
+// MahonyFilter is Robert Mahony's nonlinear complementary filter. The error between the accelerometer and the orientation is fed back into the gyro
+// through a proportional and integral controller, so the integral term also learns the bias of the gyro
+type MahonyFilter struct {
+	// Kp is the proportional gain, per second. Larger values trust the accelerometer more
+	Kp float64 `json:"kp"`
+	// Ki is the integral gain, per second squared. This corrects for gyro bias. 0 turns it off
+	Ki          float64 `json:"ki"`
+	orientation Quat
+	integral    Vec3
+}
+
+// NewMahonyFilter creates a new Mahony filter with a kp of 1 and a ki of 0.05
+func NewMahonyFilter() *MahonyFilter {
+	return &MahonyFilter{
+		Kp:          1,
+		Ki:          0.05,
+		orientation: QuatIdentity,
+	}
+}
+
+// Update integrates the gyro, corrected by the error between the orientation and the accelerometer
+func (m *MahonyFilter) Update(gyro, accel Vec3, dt float64) Quat {
+	if e, ok := accelError(m.orientation, accel); ok {
+		m.integral = m.integral.Add(e.Mul(dt))
+		gyro = gyro.Add(e.Mul(Degrees(m.Kp)).Add(m.integral.Mul(Degrees(m.Ki))))
+	}
+	m.orientation = integrateGyro(m.orientation, gyro, dt)
+	return m.orientation
+}
+
+// Reset sets the orientation back to QuatIdentity, and forgets the gyro bias
+func (m *MahonyFilter) Reset() {
+	m.orientation = QuatIdentity
+	m.integral = Zero
+}
+
+// integrateGyro turns an orientation by an angular velocity (in degrees per second, in the space of the sensor) for dt seconds
+func integrateGyro(orientation Quat, gyro Vec3, dt float64) Quat {
+	angle := gyro.Len()
+	if angle == 0 {
+		return orientation
+	}
+	return orientation.RotateByLocal(NewQuatAngleAxis(gyro, angle*dt)).Unit()
+}
+
+// accelError returns the cross product of the measured up direction (from the accelerometer) and the up direction expected from the orientation, in the space of the sensor.
+// Turning the orientation around this axis (like a gyro reading) moves it towards the accelerometer, and its length is the sine of the angle between them.
+// ok is false if the accelerometer reads zero
+func accelError(orientation Quat, accel Vec3) (Vec3, bool) {
+	if accel.Len() == 0 {
+		return Zero, false
+	}
+	expectedUp := Up.Rotated(orientation.Inv())
+	return accel.Unit().Cross(expectedUp), true
+}
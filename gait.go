@@ -0,0 +1,374 @@
+package spotpuppy
+
+import (
+	"errors"
+	"math"
+)
+
+// GaitParams describes the timing and shape of a gait
+type GaitParams struct {
+	// Period is the time (in seconds) for every leg to take one step
+	Period float64 `json:"period"`
+	// DutyFactor is the fraction of the period that each foot spends on the ground
+	DutyFactor float64 `json:"duty_factor"`
+	// PhaseOffsets is the point in the period (from 0 to 1) where each leg puts its foot down. Legs that are not in the map have an offset of 0
+	PhaseOffsets map[string]float64 `json:"phase_offsets"`
+	// StepHeight is how high each foot is lifted while it swings forwards
+	StepHeight float64 `json:"step_height"`
+	// StanceDepth is how far each foot is pushed down half way through its time on the ground
+	StanceDepth float64 `json:"stance_depth"`
+	// BodyShiftRate is how quickly (per second) the body shifts over the feet that are on the ground, to keep the robot statically stable.
+	// 0 turns body shifting off. This is only useful for slow gaits like the walk, where at least three feet are always on the ground
+	BodyShiftRate float64 `json:"body_shift_rate"`
+	// Swing creates the path for each foot to follow while it swings forwards. If it is nil, NewBezierSwing is used
+	Swing SwingGenerator `json:"-"`
+	// Stance creates the path for each foot to follow while it is on the ground. If it is nil, NewSineStance is used
+	Stance StanceGenerator `json:"-"`
+}
+
+// Validate returns an error if the params cannot be used by a GaitEngine. The period must be more than 0, and the duty factor must be between 0 and 1 (but not 0 or 1)
+func (p GaitParams) Validate() error {
+	if !(p.Period > 0) || math.IsInf(p.Period, 1) {
+		return errors.New("gait period must be more than 0")
+	}
+	if !(p.DutyFactor > 0 && p.DutyFactor < 1) {
+		return errors.New("gait duty factor must be between 0 and 1")
+	}
+	return nil
+}
+
+// GaitTrot returns the params for a trot, where diagonal pairs of legs move together
+func GaitTrot() GaitParams {
+	return GaitParams{
+		Period:     0.5,
+		DutyFactor: 0.6,
+		PhaseOffsets: map[string]float64{
+			LegFrontLeft:  0,
+			LegBackRight:  0,
+			LegFrontRight: 0.5,
+			LegBackLeft:   0.5,
+		},
+		StepHeight: 2,
+		Swing:      NewBezierSwing,
+	}
+}
+
+// GaitWalk returns the params for a walk (crawl), where one leg moves at a time so at least three feet are always on the ground.
+// All four feet are on the ground for a short time between steps, which gives the body time to shift over the next three feet
+func GaitWalk() GaitParams {
+	return GaitParams{
+		Period:     1,
+		DutyFactor: 0.85,
+		PhaseOffsets: map[string]float64{
+			LegBackLeft:   0,
+			LegFrontLeft:  0.25,
+			LegBackRight:  0.5,
+			LegFrontRight: 0.75,
+		},
+		StepHeight:    2,
+		BodyShiftRate: 10,
+		Swing:         NewBezierSwing,
+	}
+}
+
+// GaitPace returns the params for a pace, where the legs on each side move together
+func GaitPace() GaitParams {
+	return GaitParams{
+		Period:     0.5,
+		DutyFactor: 0.6,
+		PhaseOffsets: map[string]float64{
+			LegFrontLeft:  0,
+			LegBackLeft:   0,
+			LegFrontRight: 0.5,
+			LegBackRight:  0.5,
+		},
+		StepHeight: 2,
+		Swing:      NewBezierSwing,
+	}
+}
+
+// GaitBound returns the params for a bound, where the front legs move together and the back legs move together
+func GaitBound() GaitParams {
+	return GaitParams{
+		Period:     0.4,
+		DutyFactor: 0.5,
+		PhaseOffsets: map[string]float64{
+			LegFrontLeft:  0,
+			LegFrontRight: 0,
+			LegBackLeft:   0.5,
+			LegBackRight:  0.5,
+		},
+		StepHeight: 2,
+		Swing:      NewBezierSwing,
+	}
+}
+
+// GaitTripod returns the params for a tripod gait for a hexapod (see AllHexapodLegs), where the front and back legs on one side move with the middle leg on the other side,
+// so three feet are always on the ground
+func GaitTripod() GaitParams {
+	return GaitParams{
+		Period:     0.6,
+		DutyFactor: 0.55,
+		PhaseOffsets: map[string]float64{
+			LegFrontLeft:   0,
+			LegMiddleRight: 0,
+			LegBackLeft:    0,
+			LegFrontRight:  0.5,
+			LegMiddleLeft:  0.5,
+			LegBackRight:   0.5,
+		},
+		StepHeight: 2,
+		Swing:      NewBezierSwing,
+	}
+}
+
+// GaitWave returns the params for a wave gait for a hexapod (see AllHexapodLegs), where one leg moves at a time from the back to the front of each side.
+// This is the slowest, but most stable gait, with five feet always on the ground
+func GaitWave() GaitParams {
+	return GaitParams{
+		Period:     1.5,
+		DutyFactor: 0.85,
+		PhaseOffsets: map[string]float64{
+			LegBackLeft:    0,
+			LegMiddleLeft:  1.0 / 6,
+			LegFrontLeft:   2.0 / 6,
+			LegBackRight:   3.0 / 6,
+			LegMiddleRight: 4.0 / 6,
+			LegFrontRight:  5.0 / 6,
+		},
+		StepHeight: 2,
+		Swing:      NewBezierSwing,
+	}
+}
+
+// VelocityCommand is the speed that a gait should move the robot at
+type VelocityCommand struct {
+	// Forward is the forwards speed, in units (usually cm) per second
+	Forward float64
+	// Sideways is the speed to the left, in units (usually cm) per second
+	Sideways float64
+	// YawRate is the turning speed to the left, in degrees per second
+	YawRate float64
+}
+
+// GaitEngine moves the feet of a LeggedRobot (with any number of legs) in a repeating pattern to walk at a commanded velocity.
+// Feet on the ground move backwards under the body at the commanded velocity, and feet in the air swing forwards to land ahead of their neutral position
+type GaitEngine struct {
+	// Params are the params of the gait. Change them with SetParams, which checks that they are valid
+	Params  GaitParams
+	Command VelocityCommand
+	// NeutralPositions is where each foot would be (relative to its shoulder, like SetLegPosition) if the robot stood still.
+	// By default these are the resting positions of each leg
+	NeutralPositions map[string]Vec3
+	// CenterOfMass is the center of mass of the robot relative to the center of the body. It is used for body shifting and the stability margin
+	CenterOfMass Vec3
+	robot        *LeggedRobot
+	phase        float64
+	feet         map[string]Vec3
+	liftOffs     map[string]Vec3
+	stances      map[string]Trajectory
+	inStance     map[string]bool
+	bodyShift    Vec3
+	margin       float64
+}
+
+// NewGaitEngine creates a new gait engine for a quadruped, with all feet starting at their neutral positions.
+// Returns an error if the params are not valid (see GaitParams.Validate)
+func NewGaitEngine(q *LeggedRobot, params GaitParams) (*GaitEngine, error) {
+	err := params.Validate()
+	if err != nil {
+		return nil, err
+	}
+	g := &GaitEngine{
+		Params:           params,
+		NeutralPositions: make(map[string]Vec3),
+		robot:            q,
+		feet:             make(map[string]Vec3),
+		liftOffs:         make(map[string]Vec3),
+		stances:          make(map[string]Trajectory),
+		inStance:         make(map[string]bool),
+	}
+	for l, ik := range q.Legs {
+		g.NeutralPositions[l] = ik.GetRestingPosition()
+	}
+	g.Reset()
+	return g, nil
+}
+
+// Reset puts all feet back on the ground at their neutral positions, and restarts the gait cycle
+func (g *GaitEngine) Reset() {
+	g.phase = 0
+	g.bodyShift = Zero
+	for l := range g.robot.Legs {
+		g.feet[l] = g.neutralBodySpace(l)
+		g.inStance[l] = true
+		g.stances[l] = g.stanceTrajectory(g.feet[l])
+	}
+}
+
+// SetParams changes the params of the gait, without restarting the gait cycle. Returns an error, and keeps the old params, if the new params are not valid (see GaitParams.Validate)
+func (g *GaitEngine) SetParams(params GaitParams) error {
+	err := params.Validate()
+	if err != nil {
+		return err
+	}
+	g.Params = params
+	return nil
+}
+
+// SetCommand sets the velocity that the gait should move at
+func (g *GaitEngine) SetCommand(cmd VelocityCommand) {
+	g.Command = cmd
+}
+
+// Phase returns how far through the gait cycle the engine is, from 0 to 1
+func (g *GaitEngine) Phase() float64 {
+	return g.phase
+}
+
+// IsStance returns true if the foot of the leg is currently on the ground
+func (g *GaitEngine) IsStance(leg string) bool {
+	return g.inStance[leg]
+}
+
+// StabilityMargin returns the stability margin (see StabilityMargin) from the most recent step, using the feet that were on the ground.
+// If this is negative, the robot was not statically stable, and may fall if it is moving slowly
+func (g *GaitEngine) StabilityMargin() float64 {
+	return g.margin
+}
+
+// BodyShift returns how far the body has been shifted (relative to the feet) to keep it stable. This is always zero if BodyShiftRate is 0
+func (g *GaitEngine) BodyShift() Vec3 {
+	return g.bodyShift
+}
+
+// Step moves the gait forwards by dt seconds, and returns the new position of each foot, relative to its shoulder (ready for SetLegPosition)
+func (g *GaitEngine) Step(dt float64) map[string]Vec3 {
+	g.phase = math.Mod(g.phase+dt/g.Params.Period, 1)
+	move := Forward.Mul(g.Command.Forward * dt).Add(Left.Mul(g.Command.Sideways * dt))
+	turn := NewQuatAngleAxis(Up, -g.Command.YawRate*dt)
+	offsets := make(map[string]Vec3)
+	for l := range g.robot.Legs {
+		legPhase := math.Mod(g.phase-g.Params.PhaseOffsets[l]+1, 1)
+		offset := Zero
+		if legPhase < g.Params.DutyFactor {
+			if !g.inStance[l] {
+				// The foot has just landed
+				g.feet[l] = g.touchDown(l)
+				g.inStance[l] = true
+				g.stances[l] = g.stanceTrajectory(g.feet[l])
+			}
+			// Feet on the ground move the opposite way to the body, and follow the shape of the stance trajectory
+			g.feet[l] = g.feet[l].Rotated(turn).Sub(move)
+			offset = stanceOffset(g.stances[l], legPhase/g.Params.DutyFactor)
+		} else {
+			if g.inStance[l] {
+				// The foot has just lifted off
+				g.liftOffs[l] = g.feet[l]
+				g.inStance[l] = false
+			}
+			swing := (legPhase - g.Params.DutyFactor) / (1 - g.Params.DutyFactor)
+			g.feet[l] = g.swingTrajectory(g.liftOffs[l], g.touchDown(l)).Position(swing)
+		}
+		offsets[l] = offset
+	}
+	g.shiftBody(dt)
+	positions := make(map[string]Vec3)
+	for l := range g.robot.Legs {
+		positions[l] = g.robot.BodyToLeg(l, g.feet[l].Add(offsets[l]).Sub(g.bodyShift))
+	}
+	return positions
+}
+
+// shiftBody moves the body shift towards a point that is inside the support polygon now, and after the next foot lifts off, and updates the stability margin
+func (g *GaitEngine) shiftBody(dt float64) {
+	stance := make([]Vec3, 0)
+	nextLift := ""
+	nextLiftPhase := -1.0
+	for l := range g.robot.Legs {
+		if !g.inStance[l] {
+			continue
+		}
+		stance = append(stance, g.feet[l])
+		if legPhase := math.Mod(g.phase-g.Params.PhaseOffsets[l]+1, 1); legPhase > nextLiftPhase {
+			nextLift, nextLiftPhase = l, legPhase
+		}
+	}
+	if g.Params.BodyShiftRate > 0 && len(stance) > 0 {
+		next := make([]Vec3, 0)
+		for l := range g.robot.Legs {
+			if g.inStance[l] && l != nextLift {
+				next = append(next, g.feet[l])
+			}
+		}
+		// If enough feet stay down when the next foot lifts to still make a support polygon, the body can move straight over them.
+		// Otherwise, aim between the middle of the feet that are down now and the feet that will be down next, which is inside both support polygons
+		target := centroid(stance)
+		if len(next) >= 3 {
+			target = centroid(next)
+		} else if len(next) >= 2 {
+			target = target.Add(centroid(next)).Mul(0.5)
+		}
+		target = target.Sub(g.CenterOfMass)
+		target.Y = 0
+		g.bodyShift = g.bodyShift.Add(target.Sub(g.bodyShift).Mul(math.Min(1, g.Params.BodyShiftRate*dt)))
+	}
+	g.margin = StabilityMargin(g.CenterOfMass.Add(g.bodyShift), SupportPolygon(stance))
+}
+
+// centroid returns the average of some points
+func centroid(points []Vec3) Vec3 {
+	c := Zero
+	for _, p := range points {
+		c = c.Add(p)
+	}
+	return c.Mul(1 / float64(len(points)))
+}
+
+// Update moves the gait forwards by dt seconds, and sets the legs of the quadruped to the new foot positions
+func (g *GaitEngine) Update(dt float64) {
+	for l, pos := range g.Step(dt) {
+		g.robot.SetLegPosition(l, pos)
+	}
+}
+
+// neutralBodySpace returns the neutral position of a foot relative to the center of the body
+func (g *GaitEngine) neutralBodySpace(leg string) Vec3 {
+	return g.robot.LegToBody(leg, g.NeutralPositions[leg])
+}
+
+// touchDown returns where a swinging foot should land (relative to the center of the body).
+// This is ahead of the neutral position by half of the distance the body moves while the foot is on the ground, so the foot passes under its neutral position half way through the stance
+func (g *GaitEngine) touchDown(leg string) Vec3 {
+	halfStance := g.Params.Period * g.Params.DutyFactor / 2
+	move := Forward.Mul(g.Command.Forward * halfStance).Add(Left.Mul(g.Command.Sideways * halfStance))
+	turn := NewQuatAngleAxis(Up, g.Command.YawRate*halfStance)
+	return g.neutralBodySpace(leg).Rotated(turn).Add(move)
+}
+
+// stanceTrajectory returns the path for a foot that has just landed at touchDown to follow, if the command does not change before it lifts off
+func (g *GaitEngine) stanceTrajectory(touchDown Vec3) Trajectory {
+	stanceTime := g.Params.Period * g.Params.DutyFactor
+	move := Forward.Mul(g.Command.Forward * stanceTime).Add(Left.Mul(g.Command.Sideways * stanceTime))
+	turn := NewQuatAngleAxis(Up, -g.Command.YawRate*stanceTime)
+	liftOff := touchDown.Rotated(turn).Sub(move)
+	if g.Params.Stance == nil {
+		return NewSineStance(touchDown, liftOff, g.Params.StanceDepth)
+	}
+	return g.Params.Stance(touchDown, liftOff, g.Params.StanceDepth)
+}
+
+// stanceOffset returns how far a stance trajectory is from the straight line between its ends at phase.
+// The feet on the ground follow the body's actual movement, so only this offset is taken from the trajectory
+func stanceOffset(t Trajectory, phase float64) Vec3 {
+	start, end := t.Position(0), t.Position(1)
+	return t.Position(phase).Sub(start.Add(end.Sub(start).Mul(phase)))
+}
+
+// swingTrajectory returns the path for a swinging foot to follow from liftOff to touchDown
+func (g *GaitEngine) swingTrajectory(liftOff, touchDown Vec3) Trajectory {
+	if g.Params.Swing == nil {
+		return NewBezierSwing(liftOff, touchDown, g.Params.StepHeight)
+	}
+	return g.Params.Swing(liftOff, touchDown, g.Params.StepHeight)
+}
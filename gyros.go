@@ -1,14 +1,19 @@
 package spotpuppy
 
+func init() {
+	RegisterRotationSensor("dummy", func() RotationSensor { return NewDummyRotationSensor() })
+}
+
 // RotationSensor is an interface for getting the roll and pitch from a gyroscope/accelerometer
 type RotationSensor interface {
 	// GetQuaternion returns the quaternion rotation in global space of this sensor.
 	// It can also have y axis rotation, which can be cancelled out easily later to get roll and pitch.
+	// Without a magnetometer the y axis rotation drifts. With one (see MagneticHeading), Forward is north, so HeadingAngle is an absolute heading
 	GetQuaternion() Quat
 	// Calibrate tells the rotation sensor to calibrate, then waits for the action to complete
-	Calibrate()
-	// Setup should be called after the sensor is loaded
-	Setup()
+	Calibrate() error
+	// Setup should be called after the sensor is loaded. It should return an error if the hardware could not be set up, instead of panicking
+	Setup() error
 }
 
 // DummyRotationSensor is a rotation sensor that does nothing
@@ -20,13 +25,13 @@ func (d *DummyRotationSensor) GetQuaternion() Quat {
 }
 
 // Calibrate does nothing for DummyRotationSensor
-func (d *DummyRotationSensor) Calibrate() {
-
+func (d *DummyRotationSensor) Calibrate() error {
+	return nil
 }
 
 // Setup does nothing for DummyRotationSensor
-func (d *DummyRotationSensor) Setup() {
-
+func (d *DummyRotationSensor) Setup() error {
+	return nil
 }
 
 // NewDummyRotationSensor creates a new DummyRotationSensor
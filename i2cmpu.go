@@ -0,0 +1,521 @@
+package spotpuppy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/googolgl/go-i2c"
+)
+
+func init() {
+	RegisterRotationSensor("i2c_mpu", func() RotationSensor { return NewI2CMPURotationSensor() })
+}
+
+// I2CBus is a connection to a single device on an i2c bus. It is implemented by *i2c.Options from github.com/googolgl/go-i2c,
+// and can be replaced with a fake bus to test sensors without any hardware
+type I2CBus interface {
+	ReadRegBytes(reg byte, n int) ([]byte, int, error)
+	WriteRegU8(reg byte, value byte) error
+}
+
+// Registers of the MPU6050 and MPU9250 (the MPU9250 has the same accelerometer and gyro as the MPU6050)
+const (
+	mpuRegSampleRateDiv = 0x19
+	mpuRegConfig        = 0x1A
+	mpuRegGyroConfig    = 0x1B
+	mpuRegAccelConfig   = 0x1C
+	mpuRegIntPinConfig  = 0x37
+	mpuRegAccelOut      = 0x3B
+	mpuRegPowerMgmt1    = 0x6B
+	mpuRegWhoAmI        = 0x75
+)
+
+// mpuWhoAmI is the name of each chip, by the value in its WHO_AM_I register
+var mpuWhoAmI = map[byte]string{
+	0x68: "MPU6050",
+	0x70: "MPU6500",
+	0x71: "MPU9250",
+	0x73: "MPU9255",
+}
+
+// Registers and settings of the AK8963, which is the magnetometer inside the MPU9250. It has its own i2c address
+const (
+	ak8963Address      = 0x0C
+	ak8963RegWhoAmI    = 0x00
+	ak8963RegStatus1   = 0x02
+	ak8963RegControl1  = 0x0A
+	ak8963RegAdjust    = 0x10
+	ak8963WhoAmI       = 0x48
+	ak8963ModeOff      = 0x00
+	ak8963ModeFuseROM  = 0x0F
+	ak8963ModeRunning  = 0x16
+	ak8963DataReady    = 0x01
+	ak8963DataOverflow = 0x08
+)
+
+// ak8963MicroTesla is the number of microtesla in each unit measured by the AK8963
+const ak8963MicroTesla = 0.15
+
+// ak8963SwitchTime is how long the AK8963 takes to change mode
+const ak8963SwitchTime = 10 * time.Millisecond
+
+// mpuStartupTime is how long to wait for the gyro to start after waking the MPU
+const mpuStartupTime = 50 * time.Millisecond
+
+// I2CMPURotationSensor reads the accelerometer and gyro of an MPU6050 or MPU9250 directly over i2c (for example, from the i2c pins of a raspberry pi), and fuses them into a quaternion.
+// It does the same job as RawArduinoRotationSensor, but without an arduino in between
+type I2CMPURotationSensor struct {
+	// Bus is the connection to the MPU. If it is nil, Setup connects to Address on Device. It can be set to a fake bus before calling Setup for testing
+	Bus     I2CBus `json:"-"`
+	IsReady bool   `json:"-"`
+	Device  string `json:"i2c_device"`
+	Address uint8  `json:"i2c_address"`
+	// GyroRange is the largest rotation speed the gyro can measure, in deg/s. It must be 250, 500, 1000 or 2000
+	GyroRange int `json:"gyro_range"`
+	// AccelRange is the largest acceleration the accelerometer can measure, in g. It must be 2, 4, 8 or 16
+	AccelRange int `json:"accel_range"`
+	// UpdateRate is how many times per second the sensor is read
+	UpdateRate float64 `json:"update_rate"`
+	// Axes remaps the axes of the MPU into spotpuppy space. Both the gyro and accelerometer readings are remapped
+	Axes               *AxesRemapper `json:"axes_remap"`
+	ReverseGyroUp      bool          `json:"rev_gyro_up"`
+	ReverseGyroLeft    bool          `json:"rev_gyro_left"`
+	ReverseGyroForward bool          `json:"rev_gyro_forward"`
+	// Filter fuses the gyro and accelerometer readings into a rotation. If it is nil, a MahonyFilter is used.
+	// It should only be changed while the sensor is stopped
+	Filter OrientationFilter `json:"filter"`
+	// UseMagnetometer reads the magnetometer of an MPU9250 (an MPU6050 does not have one), and uses it to correct the heading with Heading
+	UseMagnetometer bool `json:"use_magnetometer"`
+	// MagBus is the connection to the magnetometer, which has its own i2c address. If it is nil, Setup connects to it on Device. It can be set to a fake bus before calling Setup for testing
+	MagBus I2CBus `json:"-"`
+	// MagCalibration is the hard and soft iron calibration of the magnetometer, in spotpuppy space. It can be found with CalibrateMagnetometer
+	MagCalibration MagCalibration `json:"mag_calibration"`
+	// Heading turns the rotation to face north using the magnetometer. If it is nil, a MagneticHeading with default settings is used.
+	// It should only be changed while the sensor is stopped
+	Heading *MagneticHeading `json:"heading"`
+	// Calibration is the calibration of the accelerometer and gyro, which is found by Calibrate and CalibrateSixPosition.
+	// It should only be changed while the sensor is stopped
+	Calibration IMUCalibration `json:"calibration"`
+	// ownsBus and ownsMagBus are true if Bus and MagBus were connected by Setup, so they should be closed by Close
+	ownsBus    bool
+	ownsMagBus bool
+	// magAdjust is the factory sensitivity adjustment of each axis of the magnetometer, in the magnetometer's own axes
+	magAdjust Vec3
+	backgroundUpdater
+}
+
+// Creates a new sensor instance for an MPU at the default address on /dev/i2c-1. Does not connect to the MPU yet, that is done from Setup()
+func NewI2CMPURotationSensor() *I2CMPURotationSensor {
+	m := &I2CMPURotationSensor{
+		IsReady:    false,
+		Device:     "/dev/i2c-1",
+		Address:    0x68,
+		GyroRange:  500,
+		AccelRange: 4,
+		UpdateRate: 200,
+		Axes:       NewAxesRemapper(Forward, Left, Down),
+		Filter:     NewMahonyFilter(),
+		Heading:    NewMagneticHeading(),
+	}
+	m.backgroundUpdater = newBackgroundUpdater(m.startUpdating)
+	return m
+}
+
+// Sets up and connects to the MPU, then starts updating in the background. If the sensor was already set up, it is closed first.
+// Returns an error if the MPU could not be found, or the settings are not valid
+func (m *I2CMPURotationSensor) Setup() error {
+	m.Close()
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
+	gyroConfig, err := mpuRangeConfig(m.GyroRange, 250)
+	if err != nil {
+		return fmt.Errorf("invalid gyro range: %w", err)
+	}
+	accelConfig, err := mpuRangeConfig(m.AccelRange, 2)
+	if err != nil {
+		return fmt.Errorf("invalid accel range: %w", err)
+	}
+	if m.UpdateRate <= 0 {
+		return errors.New("update rate must be more than 0")
+	}
+	if m.Bus == nil {
+		bus, err := i2c.New(m.Address, m.Device)
+		if err != nil {
+			return fmt.Errorf("could not connect to i2c: %w", err)
+		}
+		m.Bus = bus
+		m.ownsBus = true
+	}
+	err = m.configure(gyroConfig, accelConfig)
+	if err == nil && m.UseMagnetometer {
+		err = m.configureMagnetometer()
+	}
+	if err != nil {
+		m.closeBus()
+		return err
+	}
+	m.IsReady = true
+	return m.start()
+}
+
+// configure checks that the MPU is there, wakes it up, and sets its ranges and filtering
+func (m *I2CMPURotationSensor) configure(gyroConfig, accelConfig byte) error {
+	who, _, err := m.Bus.ReadRegBytes(mpuRegWhoAmI, 1)
+	if err != nil || len(who) != 1 {
+		return fmt.Errorf("could not find MPU at address 0x%x on %s: %v", m.Address, m.Device, err)
+	}
+	if _, ok := mpuWhoAmI[who[0]]; !ok {
+		return fmt.Errorf("device at address 0x%x on %s is not a supported MPU (WHO_AM_I is 0x%x)", m.Address, m.Device, who[0])
+	}
+	// Wake up, using the gyro's clock
+	err = m.Bus.WriteRegU8(mpuRegPowerMgmt1, 0x01)
+	if err != nil {
+		return fmt.Errorf("could not wake MPU: %w", err)
+	}
+	time.Sleep(mpuStartupTime)
+	// Sample internally at about the update rate, with the low pass filter set to about 44Hz, which removes most of the vibration from the motors
+	div := math.Round(1000/m.UpdateRate) - 1
+	settings := []struct {
+		reg   byte
+		value byte
+	}{
+		{mpuRegConfig, 0x03},
+		{mpuRegSampleRateDiv, byte(math.Max(0, math.Min(255, div)))},
+		{mpuRegGyroConfig, gyroConfig},
+		{mpuRegAccelConfig, accelConfig},
+	}
+	for _, s := range settings {
+		err = m.Bus.WriteRegU8(s.reg, s.value)
+		if err != nil {
+			return fmt.Errorf("could not configure MPU: %w", err)
+		}
+	}
+	return nil
+}
+
+// configureMagnetometer connects to the magnetometer, reads its sensitivity adjustment, and starts it measuring at 100Hz
+func (m *I2CMPURotationSensor) configureMagnetometer() error {
+	// Connect the magnetometer straight to the i2c bus, instead of through the MPU
+	err := m.Bus.WriteRegU8(mpuRegIntPinConfig, 0x02)
+	if err != nil {
+		return fmt.Errorf("could not configure MPU: %w", err)
+	}
+	if m.MagBus == nil {
+		bus, err := i2c.New(ak8963Address, m.Device)
+		if err != nil {
+			return fmt.Errorf("could not connect to i2c: %w", err)
+		}
+		m.MagBus = bus
+		m.ownsMagBus = true
+	}
+	who, _, err := m.MagBus.ReadRegBytes(ak8963RegWhoAmI, 1)
+	if err != nil || len(who) != 1 || who[0] != ak8963WhoAmI {
+		return fmt.Errorf("could not find magnetometer at address 0x%x on %s (only the MPU9250 has one): %v", ak8963Address, m.Device, err)
+	}
+	// The sensitivity adjustment can only be read in fuse rom mode, which can only be entered from off
+	for _, mode := range []byte{ak8963ModeOff, ak8963ModeFuseROM} {
+		err = m.MagBus.WriteRegU8(ak8963RegControl1, mode)
+		if err != nil {
+			return fmt.Errorf("could not configure magnetometer: %w", err)
+		}
+		time.Sleep(ak8963SwitchTime)
+	}
+	adjust, _, err := m.MagBus.ReadRegBytes(ak8963RegAdjust, 3)
+	if err != nil || len(adjust) != 3 {
+		return fmt.Errorf("could not read magnetometer sensitivity adjustment: %v", err)
+	}
+	a := func(i int) float64 {
+		return (float64(adjust[i])-128)/256 + 1
+	}
+	m.magAdjust = NewVector3(a(0), a(1), a(2))
+	for _, mode := range []byte{ak8963ModeOff, ak8963ModeRunning} {
+		err = m.MagBus.WriteRegU8(ak8963RegControl1, mode)
+		if err != nil {
+			return fmt.Errorf("could not configure magnetometer: %w", err)
+		}
+		time.Sleep(ak8963SwitchTime)
+	}
+	return nil
+}
+
+// mpuRangeConfig returns the value of the gyro or accelerometer config register that selects a range. The ranges are smallest, then double, four times and eight times that
+func mpuRangeConfig(value, smallest int) (byte, error) {
+	for i := 0; i < 4; i++ {
+		if value == smallest<<i {
+			return byte(i << 3), nil
+		}
+	}
+	return 0, fmt.Errorf("%d must be one of %d, %d, %d or %d", value, smallest, smallest*2, smallest*4, smallest*8)
+}
+
+// Close stops updating, and closes the i2c connection if it was opened by Setup. Setup must be called again before the sensor can be used
+func (m *I2CMPURotationSensor) Close() error {
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
+	m.stopAndWait()
+	m.IsReady = false
+	return m.closeBus()
+}
+
+// closeBus closes and forgets Bus and MagBus if they were opened by Setup. A bus that was set by the user is left open. lifecycle must be held
+func (m *I2CMPURotationSensor) closeBus() error {
+	var err error
+	if m.ownsBus {
+		if c, ok := m.Bus.(io.Closer); ok {
+			err = c.Close()
+		}
+		m.Bus = nil
+		m.ownsBus = false
+	}
+	if m.ownsMagBus {
+		if c, ok := m.MagBus.(io.Closer); ok {
+			err = c.Close()
+		}
+		m.MagBus = nil
+		m.ownsMagBus = false
+	}
+	return err
+}
+
+// Calibrates the sensors gyro, by measuring its bias. The sensor must be very still for this.
+// If the accelerometer has not been calibrated by CalibrateSixPosition, the sensor must also be flat, and the accelerometer offset is found too.
+// Otherwise, the sensor can be in any position, and the accelerometer calibration is kept.
+// If the MPU cannot be read, the sensor stops updating and the error is returned (see Restart)
+func (m *I2CMPURotationSensor) Calibrate() error {
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
+	if !m.IsReady {
+		return errors.New("rotation sensor has not been set up")
+	}
+	m.stopAndWait()
+
+	// When flat and still, the accelerometer should read 1g straight up
+	c, err := calibrateStill(m.Calibration, Up, m.calibrationSampler())
+	if err != nil {
+		m.setErr(err)
+		return err
+	}
+	m.Calibration = c
+
+	// Restart update in background
+	return m.start()
+}
+
+// CalibrateSixPosition calibrates the offset and scale of each axis of the accelerometer, and the bias of the gyro, with the robot held still in each of SixPositions.
+// Before each position, ready is called with the position, and should return once the robot is still in that position (for example, after asking the user to press enter).
+// Returning an error from ready cancels the calibration. The positions do not need to be exactly level.
+// The results are saved to Calibration, so save the sensor with SaveRotationSensorToFile afterwards to keep them
+func (m *I2CMPURotationSensor) CalibrateSixPosition(ready func(CalibrationPosition) error) error {
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
+	if !m.IsReady {
+		return errors.New("rotation sensor has not been set up")
+	}
+	m.stopAndWait()
+
+	c, err := calibrateSixPosition(ready, m.calibrationSampler())
+	if err != nil {
+		m.setErr(err)
+		return err
+	}
+	m.Calibration = c
+
+	// Restart update in background
+	return m.start()
+}
+
+// calibrationSampler returns a function that reads the raw gyro and accelerometer at UpdateRate. The update thread must be stopped
+func (m *I2CMPURotationSensor) calibrationSampler() func() (Vec3, Vec3, error) {
+	var last time.Time
+	return func() (Vec3, Vec3, error) {
+		time.Sleep(time.Until(last.Add(m.updatePeriod())))
+		last = time.Now()
+		return m.readSample()
+	}
+}
+
+// CalibrateMagnetometer reads the magnetometer for the given number of seconds, then finds its hard and soft iron calibration and saves it to MagCalibration.
+// While it is reading, the robot should be turned to face as many directions as possible (including upside down). Save the sensor with SaveRotationSensorToFile afterwards to keep the calibration.
+// If the magnetometer cannot be read, the sensor stops updating and the error is returned (see Restart). If the calibration cannot be found, the old calibration is kept
+func (m *I2CMPURotationSensor) CalibrateMagnetometer(seconds float64) error {
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
+	if !m.IsReady {
+		return errors.New("rotation sensor has not been set up")
+	}
+	if !m.UseMagnetometer {
+		return errors.New("the magnetometer is not turned on")
+	}
+	m.stopAndWait()
+
+	samples := make([]Vec3, 0)
+	ticker := time.NewTicker(m.updatePeriod())
+	defer ticker.Stop()
+	for end := time.Now().Add(time.Duration(seconds * float64(time.Second))); time.Now().Before(end); {
+		<-ticker.C
+		mag, ok, err := m.readMag()
+		if err != nil {
+			m.setErr(err)
+			return err
+		}
+		if ok {
+			samples = append(samples, mag)
+		}
+	}
+	c, err := FitMagCalibration(samples)
+	if err != nil {
+		// The readings were fine, so keep updating with the old calibration
+		startErr := m.start()
+		if startErr != nil {
+			return fmt.Errorf("%w (and the sensor could not restart: %v)", err, startErr)
+		}
+		return err
+	}
+	m.MagCalibration = c
+
+	// Restart update in background
+	return m.start()
+}
+
+// i2cMPURotationSensorJSON has the same fields as I2CMPURotationSensor, but none of its methods, so it can be used inside I2CMPURotationSensor's json methods
+type i2cMPURotationSensorJSON I2CMPURotationSensor
+
+// MarshalJSON saves the sensor, including the registered type name of the filter
+func (m *I2CMPURotationSensor) MarshalJSON() ([]byte, error) {
+	return marshalWithFilter((*i2cMPURotationSensorJSON)(m), m.Filter)
+}
+
+// UnmarshalJSON loads the sensor. If the filter was saved with a registered type name, and the existing filter is not already that type,
+// a new filter of that type is created
+func (m *I2CMPURotationSensor) UnmarshalJSON(data []byte) error {
+	return unmarshalWithFilter(data, (*i2cMPURotationSensorJSON)(m), &m.Filter)
+}
+
+// updatePeriod returns the time between each reading of the MPU
+func (m *I2CMPURotationSensor) updatePeriod() time.Duration {
+	return time.Duration(float64(time.Second) / m.UpdateRate)
+}
+
+// startUpdating starts the update thread with a fresh filter and heading. lifecycle must be held
+func (m *I2CMPURotationSensor) startUpdating(stop <-chan struct{}, done chan<- struct{}) error {
+	if !m.IsReady {
+		return errors.New("rotation sensor has not been set up")
+	}
+	filter := m.Filter
+	if filter == nil {
+		filter = NewMahonyFilter()
+	}
+	filter.Reset()
+	heading := m.Heading
+	if heading == nil {
+		heading = NewMagneticHeading()
+	}
+	heading.Reset()
+	go m.updateInBackground(filter, heading, m.Calibration, stop, done)
+	return nil
+}
+
+// This reads the MPU at UpdateRate in the background so that the update loop always gets the most up to date info without having to wait.
+// It stops when stop is closed, or when the MPU cannot be read, and closes done when it has stopped
+func (m *I2CMPURotationSensor) updateInBackground(filter OrientationFilter, heading *MagneticHeading, calibration IMUCalibration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(m.updatePeriod())
+	defer ticker.Stop()
+	lastUpdate := time.Now()
+	m.setRotation(QuatIdentity)
+	// The magnetometer measures less often than the MPU, so the last reading is kept between measurements
+	var mag Vec3
+	hasMag := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// Read the MPU. If it fails, stop updating, and keep the error so it can be checked with Err
+		gyro, accel, err := m.readSample()
+		if err != nil {
+			m.setErr(err)
+			return
+		}
+
+		// Time managment
+		thisUpdate := time.Now()
+		dt := thisUpdate.Sub(lastUpdate)
+		lastUpdate = thisUpdate
+
+		orientation := filter.Update(calibration.ApplyGyro(gyro), calibration.ApplyAccel(accel), dt.Seconds())
+
+		if m.UseMagnetometer {
+			raw, ok, err := m.readMag()
+			if err != nil {
+				m.setErr(err)
+				return
+			}
+			if ok {
+				mag = m.MagCalibration.Apply(raw)
+				hasMag = true
+			}
+			if hasMag {
+				orientation = heading.Update(orientation, mag, dt.Seconds())
+			}
+		}
+
+		// Copy our new rotation back to the cachedRot
+		m.setRotation(orientation)
+	}
+}
+
+// readSample reads the gyro (in deg/s) and accelerometer (in g) from the MPU, converted to spotpuppy space, with the gyros reversed if need be
+func (m *I2CMPURotationSensor) readSample() (Vec3, Vec3, error) {
+	buf, _, err := m.Bus.ReadRegBytes(mpuRegAccelOut, 14)
+	if err != nil {
+		return Zero, Zero, fmt.Errorf("failed to read from MPU at address 0x%x on %s: %w", m.Address, m.Device, err)
+	}
+	if len(buf) != 14 {
+		return Zero, Zero, fmt.Errorf("failed to read from MPU at address 0x%x on %s: expected 14 bytes but got %d", m.Address, m.Device, len(buf))
+	}
+	// The registers are accel x, y, z, then temperature, then gyro x, y, z, each as a big endian int16
+	value := func(i int) float64 {
+		return float64(int16(uint16(buf[i*2])<<8 | uint16(buf[i*2+1])))
+	}
+	accelScale := float64(m.AccelRange) / 32768
+	gyroScale := float64(m.GyroRange) / 32768
+	accel := m.Axes.Remap(NewVector3(value(0), value(1), value(2)).Mul(accelScale))
+	gyro := m.Axes.Remap(NewVector3(value(4), value(5), value(6)).Mul(gyroScale))
+	if m.ReverseGyroForward {
+		gyro.X *= -1
+	}
+	if m.ReverseGyroUp {
+		gyro.Y *= -1
+	}
+	if m.ReverseGyroLeft {
+		gyro.Z *= -1
+	}
+	return gyro, accel, nil
+}
+
+// readMag reads the magnetometer (in microtesla), converted to spotpuppy space. ok is false if there is no new measurement, or the measurement overflowed
+func (m *I2CMPURotationSensor) readMag() (Vec3, bool, error) {
+	// Reading up to the second status register tells the magnetometer that the measurement has been read
+	buf, _, err := m.MagBus.ReadRegBytes(ak8963RegStatus1, 8)
+	if err != nil {
+		return Zero, false, fmt.Errorf("failed to read from magnetometer on %s: %w", m.Device, err)
+	}
+	if len(buf) != 8 {
+		return Zero, false, fmt.Errorf("failed to read from magnetometer on %s: expected 8 bytes but got %d", m.Device, len(buf))
+	}
+	if buf[0]&ak8963DataReady == 0 || buf[7]&ak8963DataOverflow != 0 {
+		return Zero, false, nil
+	}
+	// The measurements are x, y, z, each as a little endian int16
+	value := func(i int) float64 {
+		return float64(int16(uint16(buf[1+i*2]) | uint16(buf[2+i*2])<<8))
+	}
+	raw := NewVector3(value(0), value(1), value(2)).MulVec(m.magAdjust).Mul(ak8963MicroTesla)
+	// The magnetometer's x and y are swapped compared to the MPU, and its z points the other way
+	return m.Axes.Remap(NewVector3(raw.Y, raw.X, -raw.Z)), true, nil
+}
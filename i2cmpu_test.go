@@ -0,0 +1,198 @@
+package spotpuppy
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeI2CBus is an I2CBus that stores registers in memory, and records every write
+type fakeI2CBus struct {
+	mu      sync.Mutex
+	regs    map[byte][]byte
+	writes  [][2]byte
+	readErr error
+}
+
+func newFakeMPUBus(whoAmI byte) *fakeI2CBus {
+	return &fakeI2CBus{
+		regs: map[byte][]byte{
+			mpuRegWhoAmI:   {whoAmI},
+			mpuRegAccelOut: make([]byte, 14),
+		},
+	}
+}
+
+func (b *fakeI2CBus) ReadRegBytes(reg byte, n int) ([]byte, int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.readErr != nil {
+		return nil, 0, b.readErr
+	}
+	buf := make([]byte, n)
+	copy(buf, b.regs[reg])
+	return buf, n, nil
+}
+
+func (b *fakeI2CBus) WriteRegU8(reg byte, value byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writes = append(b.writes, [2]byte{reg, value})
+	return nil
+}
+
+// written returns the last value written to reg, and whether it was written at all
+func (b *fakeI2CBus) written(reg byte) (byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(b.writes) - 1; i >= 0; i-- {
+		if b.writes[i][0] == reg {
+			return b.writes[i][1], true
+		}
+	}
+	return 0, false
+}
+
+// setSample stores raw accelerometer and gyro readings (in chip axes) in the output registers, as big endian int16s
+func (b *fakeI2CBus) setSample(accel, gyro [3]int16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	buf := make([]byte, 14)
+	put := func(i int, v int16) {
+		buf[i*2] = byte(uint16(v) >> 8)
+		buf[i*2+1] = byte(uint16(v))
+	}
+	for i := 0; i < 3; i++ {
+		put(i, accel[i])
+		put(i+4, gyro[i])
+	}
+	b.regs[mpuRegAccelOut] = buf
+}
+
+func (b *fakeI2CBus) setReadErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readErr = err
+}
+
+func newTestMPU(bus *fakeI2CBus) *I2CMPURotationSensor {
+	m := NewI2CMPURotationSensor()
+	m.Bus = bus
+	return m
+}
+
+func TestI2CMPURejectsUnknownWhoAmI(t *testing.T) {
+	m := newTestMPU(newFakeMPUBus(0x12))
+	err := m.Setup()
+	if err == nil {
+		m.Close()
+		t.Fatal("expected Setup to fail for an unknown WHO_AM_I")
+	}
+	if m.IsReady {
+		t.Error("sensor should not be ready after Setup fails")
+	}
+}
+
+func TestI2CMPUWritesRangeConfig(t *testing.T) {
+	cases := []struct {
+		gyroRange, accelRange   int
+		gyroConfig, accelConfig byte
+	}{
+		{250, 2, 0x00, 0x00},
+		{500, 4, 0x08, 0x08},
+		{1000, 8, 0x10, 0x10},
+		{2000, 16, 0x18, 0x18},
+	}
+	for _, c := range cases {
+		bus := newFakeMPUBus(0x68)
+		m := newTestMPU(bus)
+		m.GyroRange, m.AccelRange = c.gyroRange, c.accelRange
+		err := m.Setup()
+		if err != nil {
+			t.Fatalf("gyro range %d, accel range %d: %v", c.gyroRange, c.accelRange, err)
+		}
+		m.Close()
+		if v, ok := bus.written(mpuRegPowerMgmt1); !ok || v != 0x01 {
+			t.Errorf("power management was not set to wake the MPU (got 0x%x)", v)
+		}
+		if v, ok := bus.written(mpuRegGyroConfig); !ok || v != c.gyroConfig {
+			t.Errorf("gyro range %d: gyro config is 0x%x, expected 0x%x", c.gyroRange, v, c.gyroConfig)
+		}
+		if v, ok := bus.written(mpuRegAccelConfig); !ok || v != c.accelConfig {
+			t.Errorf("accel range %d: accel config is 0x%x, expected 0x%x", c.accelRange, v, c.accelConfig)
+		}
+		// The default update rate of 200Hz divides the 1kHz internal rate by 5
+		if v, ok := bus.written(mpuRegSampleRateDiv); !ok || v != 4 {
+			t.Errorf("sample rate divider is %d, expected 4", v)
+		}
+	}
+}
+
+func TestI2CMPURejectsInvalidRange(t *testing.T) {
+	m := newTestMPU(newFakeMPUBus(0x68))
+	m.GyroRange = 300
+	if err := m.Setup(); err == nil {
+		m.Close()
+		t.Fatal("expected Setup to fail for a gyro range of 300")
+	}
+}
+
+func TestI2CMPUScalesAndRemapsSamples(t *testing.T) {
+	bus := newFakeMPUBus(0x71)
+	m := newTestMPU(bus)
+	m.GyroRange, m.AccelRange = 500, 4
+	m.ReverseGyroForward = true
+	err := m.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Stop()
+	defer m.Close()
+	// 8192 is 1g at a range of 4g, and 16384 is 250deg/s at a range of 500deg/s
+	bus.setSample([3]int16{8192, 4096, -2048}, [3]int16{16384, -8192, 4096})
+	gyro, accel, err := m.readSample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// By default, chip x is forward, chip y is left, and chip z is up
+	expectAccel := NewVector3(1, 0.25, 0.5)
+	expectGyro := NewVector3(-250, -62.5, -125)
+	if accel.Sub(expectAccel).Len() > 1e-9 {
+		t.Errorf("accel is %v, expected %v", accel, expectAccel)
+	}
+	if gyro.Sub(expectGyro).Len() > 1e-9 {
+		t.Errorf("gyro is %v, expected %v", gyro, expectGyro)
+	}
+}
+
+func TestI2CMPUReadErrorShowsInErr(t *testing.T) {
+	bus := newFakeMPUBus(0x68)
+	m := newTestMPU(bus)
+	err := m.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	readErr := errors.New("bus unplugged")
+	bus.setReadErr(readErr)
+	deadline := time.Now().Add(time.Second)
+	for m.Err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("read error was not reported by Err")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !errors.Is(m.Err(), readErr) {
+		t.Errorf("Err is %v, expected it to wrap %v", m.Err(), readErr)
+	}
+	// Once the bus works again, Restart clears the error
+	bus.setReadErr(nil)
+	err = m.Restart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Err() != nil {
+		t.Errorf("Err is %v after Restart, expected nil", m.Err())
+	}
+}
@@ -5,12 +5,19 @@ import (
 	"math"
 )
 
+func init() {
+	RegisterLegIK("direct_motor", NewDirectMotorIKGenerator())
+}
+
 // LegIK describes types that can calculate motor rotations from a foot endpoint
 type LegIK interface {
 	// CalculateMotorRotations gets a list of motor rotations from a foot position relative to this leg.
 	// The returned servo positions should be in the same order as GetMotorNames
 	// (ie the first value of the rotations should be for the first servo name returned by GetMotorNames)
 	CalculateMotorRotations(vector Vec3) []float64
+	// CalculateFootPosition is the inverse of CalculateMotorRotations (forward kinematics).
+	// It takes a list of motor rotations, in the same order as GetMotorNames, and returns the position of the foot relative to this leg
+	CalculateFootPosition(rotations []float64) Vec3
 	// GetMotorNames returns a list of the motor names of this leg. See CalculateMotorRotations for more info
 	GetMotorNames() []string
 	// GetRestingPosition returns the position of the foot of this leg such that the motor rotations are all 0
@@ -19,6 +26,59 @@ type LegIK interface {
 	LoadJson(data []byte) error
 }
 
+// SolvingLegIK describes LegIK types that can report how well they reached a foot position, instead of silently clamping it
+type SolvingLegIK interface {
+	LegIK
+	// SolveMotorRotations does the same as CalculateMotorRotations, but also reports whether the foot position could be reached
+	SolveMotorRotations(vector Vec3) IKResult
+}
+
+// IKResult describes the motor rotations for a foot position, and how well they reach that position
+type IKResult struct {
+	// Rotations are the motor rotations, in the same order as GetMotorNames
+	Rotations []float64
+	// Reachable is true if the foot reaches the target position without any of the joints saturating
+	Reachable bool
+	// Saturated has an entry for each motor, which is true if that motor had to be limited to stay within its range
+	Saturated []bool
+	// Achieved is the position that the foot will actually be at with these rotations
+	Achieved Vec3
+}
+
+// reachTolerance is how far (in the same units as the leg) the foot can be from its target while still counting as reachable
+const reachTolerance = 0.01
+
+// SolveLegIK calculates the motor rotations for a foot position, and reports how well the leg reaches that position.
+// If the LegIK is not a SolvingLegIK, the rotations are limited to the range of each motor (see LimitedLegIK) first, then the achieved position is found with forward kinematics
+func SolveLegIK(ik LegIK, pos Vec3) IKResult {
+	if sik, ok := ik.(SolvingLegIK); ok {
+		return sik.SolveMotorRotations(pos)
+	}
+	// Copy the rotations, as newIKResult limits them in place
+	rotations := append([]float64{}, ik.CalculateMotorRotations(pos)...)
+	result := newIKResult(ik, rotations, getMotorLimits(ik), true)
+	result.Reachable = result.Reachable && result.Achieved.Sub(pos).Len() <= reachTolerance
+	return result
+}
+
+// newIKResult applies the limits to each rotation, and creates an IKResult recording which rotations had to be limited.
+// The achieved position is found with forward kinematics
+func newIKResult(ik LegIK, rotations []float64, limits []JointLimit, inReach bool) IKResult {
+	reachable := inReach
+	saturated := make([]bool, len(rotations))
+	for i, r := range rotations {
+		rotations[i] = limits[i].Limit(r)
+		saturated[i] = rotations[i] != r
+		reachable = reachable && !saturated[i]
+	}
+	return IKResult{
+		Rotations: rotations,
+		Reachable: reachable,
+		Saturated: saturated,
+		Achieved:  ik.CalculateFootPosition(rotations),
+	}
+}
+
 // DirectMotorIK is an IK driver for 3 jointed legs (like Spot Mini), with one motor at each joint (no control rods or gears),
 // and where the distance form foot to knee is the same as knee to hip
 type DirectMotorIK struct {
@@ -29,40 +89,56 @@ type DirectMotorIK struct {
 	KneeOffset       float64 `json:"knee_offset"`
 	HipXOffset       float64 `json:"hip_x_offset"`
 	HipZOffset       float64 `json:"hip_z_offset"`
+	// HipZLimit, HipXLimit and KneeLimit are the ranges of each motor. If they are nil, the motor can move from -90 to 90
+	HipZLimit *JointLimit `json:"hip_z_limit"`
+	HipXLimit *JointLimit `json:"hip_x_limit"`
+	KneeLimit *JointLimit `json:"knee_limit"`
 	// BoneLength is the length from the foot to the knee
 	BoneLength float64 `json:"bone_length"`
 }
 
 // CalculateMotorRotations calculates the rotations of the three motors, and returns them in the order (hip left right, hip forwards backwords, knee)
 func (dm *DirectMotorIK) CalculateMotorRotations(pos Vec3) []float64 {
+	return dm.SolveMotorRotations(pos).Rotations
+}
+
+// SolveMotorRotations calculates the rotations of the three motors, in the order (hip left right, hip forwards backwords, knee),
+// and reports whether the foot could reach pos
+func (dm *DirectMotorIK) SolveMotorRotations(pos Vec3) IKResult {
 	if dm.FlipXAxis {
 		pos.X = -pos.X
 	}
 	dist := pos.Len()
-	if dist >= 2*dm.BoneLength {
-		pos.Mul(1.999 * dm.BoneLength / dist)
+	inReach := dist < 2*dm.BoneLength
+	if !inReach {
+		pos = pos.Mul(1.999 * dm.BoneLength / dist)
 	}
-	// Generate angles
+	// Generate angles. The hip x joint works in the plane that the hip z joint has rotated the leg into
 	kd := dm.kneeDegrees(dist)
-	hxd := (kd / 2) + dm.degreesBetween(pos.X, pos.Y)
+	hxd := (kd / 2) + dm.degreesBetween(pos.X, math.Sqrt(pos.Y*pos.Y+pos.Z*pos.Z))
 	hzd := dm.degreesBetween(pos.Z, pos.Y)
 	// Make angles centered around 0
 	kd = kd - 90
 	hxd = hxd - 135
 	hzd = hzd - 90
-	if dm.ReverseKneeJoint {
-		kd = -kd
-	}
-	if dm.ReverseHipXJoint {
-		hxd = -hxd
-	}
-	if dm.ReverseHipZJoint {
-		hzd = -hzd
+	return newIKResult(dm, dm.motorMapping().toMotors(hzd, hxd, kd), dm.GetMotorLimits(), inReach)
+}
+
+// CalculateFootPosition calculates the position of the foot from the rotations of the three motors, in the order (hip left right, hip forwards backwords, knee)
+func (dm *DirectMotorIK) CalculateFootPosition(rotations []float64) Vec3 {
+	hzd, hxd, kd := dm.motorMapping().fromMotors(rotations)
+	kd += 90
+	hxd += 135
+	hzd += 90
+	// Find the foot in the plane of the leg, then rotate that plane around the hip z joint
+	dist := 2 * dm.BoneLength * math.Sin(Radians(kd/2))
+	footAngle := Radians(hxd - kd/2)
+	inPlane := dist * math.Sin(footAngle)
+	pos := NewVector3(dist*math.Cos(footAngle), inPlane*math.Sin(Radians(hzd)), inPlane*math.Cos(Radians(hzd)))
+	if dm.FlipXAxis {
+		pos.X = -pos.X
 	}
-	kd += dm.KneeOffset
-	hxd += dm.HipXOffset
-	hzd += dm.HipZOffset
-	return []float64{clamp(hzd, -90, 90), clamp(hxd, -90, 90), clamp(kd, -90, 90)}
+	return pos
 }
 func clamp(x, mi, ma float64) float64 {
 	if x < mi {
@@ -80,11 +156,42 @@ func (dm *DirectMotorIK) kneeDegrees(dist float64) float64 {
 	} else if ratio < 0 {
 		ratio = 0
 	}
-	return (180.0 / 3.14159) * (2 * math.Asin(ratio))
+	return Degrees(2 * math.Asin(ratio))
 }
 
 func (dm *DirectMotorIK) degreesBetween(x, y float64) float64 {
-	return math.Atan2(y, x) * (180.0 / 3.14159)
+	return Degrees(math.Atan2(y, x))
+}
+
+// motorMapping reverses and offsets the joint angles (centered around 0) of a leg with three motors, in the order (hip left right, hip forwards backwords, knee), to get motor rotations.
+// It is shared by the IKs that have ReverseHipZJoint, HipZOffset and so on
+type motorMapping struct {
+	reverse [3]bool
+	offset  [3]float64
+}
+
+// toMotors reverses then offsets the joint angles
+func (m motorMapping) toMotors(hzd, hxd, kd float64) []float64 {
+	rotations := []float64{hzd, hxd, kd}
+	for i := range rotations {
+		if m.reverse[i] {
+			rotations[i] = -rotations[i]
+		}
+		rotations[i] += m.offset[i]
+	}
+	return rotations
+}
+
+// fromMotors undoes toMotors, finding the joint angles from motor rotations
+func (m motorMapping) fromMotors(rotations []float64) (hzd, hxd, kd float64) {
+	joints := [3]float64{}
+	for i := range joints {
+		joints[i] = rotations[i] - m.offset[i]
+		if m.reverse[i] {
+			joints[i] = -joints[i]
+		}
+	}
+	return joints[0], joints[1], joints[2]
 }
 
 var directMotorIKNames = []string{"hip_z", "hip_x", "knee"}
@@ -93,6 +200,19 @@ func (dm *DirectMotorIK) GetMotorNames() []string {
 	return directMotorIKNames
 }
 
+// motorMapping returns how the joint angles of this leg are reversed and offset to get motor rotations
+func (dm *DirectMotorIK) motorMapping() motorMapping {
+	return motorMapping{
+		reverse: [3]bool{dm.ReverseHipZJoint, dm.ReverseHipXJoint, dm.ReverseKneeJoint},
+		offset:  [3]float64{dm.HipZOffset, dm.HipXOffset, dm.KneeOffset},
+	}
+}
+
+// GetMotorLimits returns the limits of the three motors, in the order (hip left right, hip forwards backwords, knee)
+func (dm *DirectMotorIK) GetMotorLimits() []JointLimit {
+	return []JointLimit{jointLimitOrDefault(dm.HipZLimit), jointLimitOrDefault(dm.HipXLimit), jointLimitOrDefault(dm.KneeLimit)}
+}
+
 // GetRestingPosition returns the position where all of the joints are at 0 degrees
 func (dm *DirectMotorIK) GetRestingPosition() Vec3 {
 	return NewVector3(0, math.Sqrt(math.Pow(dm.BoneLength, 2)*2), 0)
@@ -114,6 +234,9 @@ func NewDirectMotorIKGenerator() func() LegIK {
 			KneeOffset:       0,
 			HipXOffset:       0,
 			HipZOffset:       0,
+			HipZLimit:        NewJointLimit(-90, 90),
+			HipXLimit:        NewJointLimit(-90, 90),
+			KneeLimit:        NewJointLimit(-90, 90),
 			BoneLength:       6,
 		}
 	}
@@ -0,0 +1,187 @@
+package spotpuppy
+
+import (
+	"encoding/json"
+	"math"
+)
+
+func init() {
+	RegisterLegIK("chain", NewChainIKGenerator())
+}
+
+// ChainJoint is a single rotating joint (with one motor) in a ChainIK
+type ChainJoint struct {
+	// Name is the name of the motor at this joint
+	Name string `json:"name"`
+	// Offset is the position of this joint relative to the previous joint (or the shoulder for the first joint), when the previous joint is at 0 degrees
+	Offset Vec3 `json:"offset"`
+	// Axis is the axis that this joint rotates around, when the previous joint is at 0 degrees. Positive rotations are anticlockwise when looking back along the axis
+	Axis Vec3 `json:"axis"`
+	// Limit is the range of this joint. If it is nil, the motor can move from -90 to 90
+	Limit *JointLimit `json:"limit"`
+}
+
+// ChainIK is a generic IK driver for legs described as a chain of rotating joints, each with one motor.
+// The forward kinematics are found by following the chain, and the IK is solved iteratively with damped least squares, starting from the last solution.
+// This is slower than a hand written IK driver, but works for any number of joints and any leg geometry.
+// A ChainIK should only be used from one goroutine at a time, as it remembers its last solution
+type ChainIK struct {
+	Joints []ChainJoint `json:"joints"`
+	// FootOffset is the position of the foot relative to the last joint, when that joint is at 0 degrees
+	FootOffset Vec3 `json:"foot_offset"`
+	// Iterations is the maximum number of iterations to run for each solve
+	Iterations int `json:"iterations"`
+	// Damping stops the solver from making huge jumps near singularities (like when the leg is straight). Larger is more stable, but slower to converge
+	Damping float64 `json:"damping"`
+	// Tolerance is how close (in the same units as the leg) the foot must be to the target before the solver stops
+	Tolerance    float64 `json:"tolerance"`
+	lastSolution []float64
+}
+
+// CalculateMotorRotations calculates the rotations of each joint, in the same order as the joints
+func (ck *ChainIK) CalculateMotorRotations(pos Vec3) []float64 {
+	return ck.SolveMotorRotations(pos).Rotations
+}
+
+// SolveMotorRotations calculates the rotations of each joint, in the same order as the joints, and reports whether the foot could reach pos
+func (ck *ChainIK) SolveMotorRotations(pos Vec3) IKResult {
+	limits := ck.GetMotorLimits()
+	rotations := make([]float64, len(ck.Joints))
+	if len(ck.lastSolution) == len(rotations) {
+		copy(rotations, ck.lastSolution)
+	}
+	// The jacobian is found numerically, by nudging each joint by this many degrees
+	const nudge = 1e-4
+	errorLen := math.Inf(1)
+	for i := 0; i < ck.Iterations; i++ {
+		foot := ck.CalculateFootPosition(rotations)
+		err := pos.Sub(foot)
+		errorLen = err.Len()
+		if errorLen <= ck.Tolerance {
+			break
+		}
+		jacobian := make([]Vec3, len(rotations))
+		for j := range rotations {
+			rotations[j] += nudge
+			jacobian[j] = ck.CalculateFootPosition(rotations).Sub(foot).Mul(1 / Radians(nudge))
+			rotations[j] -= nudge
+		}
+		// Damped least squares: change = J^T (J J^T + damping^2 I)^-1 err
+		jjt := [3][3]float64{}
+		for _, col := range jacobian {
+			c := [3]float64{col.X, col.Y, col.Z}
+			for r := 0; r < 3; r++ {
+				for k := 0; k < 3; k++ {
+					jjt[r][k] += c[r] * c[k]
+				}
+			}
+		}
+		for r := 0; r < 3; r++ {
+			jjt[r][r] += ck.Damping * ck.Damping
+		}
+		inv, ok := invert3(jjt)
+		if !ok {
+			break
+		}
+		e := [3]float64{err.X, err.Y, err.Z}
+		f := NewVector3(
+			inv[0][0]*e[0]+inv[0][1]*e[1]+inv[0][2]*e[2],
+			inv[1][0]*e[0]+inv[1][1]*e[1]+inv[1][2]*e[2],
+			inv[2][0]*e[0]+inv[2][1]*e[1]+inv[2][2]*e[2],
+		)
+		for j := range rotations {
+			rotations[j] = limits[j].Clamp(rotations[j] + Degrees(jacobian[j].Dot(f)))
+		}
+	}
+	ck.lastSolution = append(ck.lastSolution[:0], rotations...)
+	if errorLen > ck.Tolerance {
+		errorLen = ck.CalculateFootPosition(rotations).Sub(pos).Len()
+	}
+	result := newIKResult(ck, rotations, limits, errorLen <= reachTolerance)
+	// The solver keeps joints inside their hard limits, so if the foot did not reach, any joint sat on a limit is what stopped it
+	if !result.Reachable {
+		for j, r := range rotations {
+			result.Saturated[j] = result.Saturated[j] || r <= limits[j].Min || r >= limits[j].Max
+		}
+	}
+	return result
+}
+
+// CalculateFootPosition follows the chain of joints to find the position of the foot
+func (ck *ChainIK) CalculateFootPosition(rotations []float64) Vec3 {
+	pos := Zero
+	rot := QuatIdentity
+	for i, j := range ck.Joints {
+		pos = pos.Add(j.Offset.Rotated(rot))
+		rot = rot.RotateByLocal(NewQuatAngleAxis(j.Axis, rotations[i]))
+	}
+	return pos.Add(ck.FootOffset.Rotated(rot))
+}
+
+// GetMotorNames returns the name of each joint
+func (ck *ChainIK) GetMotorNames() []string {
+	names := make([]string, len(ck.Joints))
+	for i, j := range ck.Joints {
+		names[i] = j.Name
+	}
+	return names
+}
+
+// GetMotorLimits returns the limit of each joint
+func (ck *ChainIK) GetMotorLimits() []JointLimit {
+	limits := make([]JointLimit, len(ck.Joints))
+	for i, j := range ck.Joints {
+		limits[i] = jointLimitOrDefault(j.Limit)
+	}
+	return limits
+}
+
+// GetRestingPosition returns the position where all of the joints are at 0 degrees
+func (ck *ChainIK) GetRestingPosition() Vec3 {
+	return ck.CalculateFootPosition(make([]float64, len(ck.Joints)))
+}
+
+// Loads json data into this object
+func (ck *ChainIK) LoadJson(data []byte) error {
+	ck.lastSolution = nil
+	return json.Unmarshal(data, ck)
+}
+
+// NewChainIKGenerator creates a function to create ChainIK structs. This is used by robot to create a seperate controller for each leg.
+// The default chain has the same geometry and motors as a DirectMotorIK with a bone length of 6, so it can be used to check other IK drivers
+func NewChainIKGenerator() func() LegIK {
+	return func() LegIK {
+		bone := 6 / math.Sqrt2
+		return &ChainIK{
+			Joints: []ChainJoint{
+				{Name: "hip_z", Offset: Zero, Axis: Backward, Limit: NewJointLimit(-90, 90)},
+				{Name: "hip_x", Offset: Zero, Axis: Left, Limit: NewJointLimit(-90, 90)},
+				{Name: "knee", Offset: NewVector3(bone, bone, 0), Axis: Right, Limit: NewJointLimit(-90, 90)},
+			},
+			FootOffset: NewVector3(-bone, bone, 0),
+			Iterations: 50,
+			Damping:    0.05,
+			Tolerance:  0.001,
+		}
+	}
+}
+
+// invert3 inverts a 3x3 matrix. ok is false if the matrix cannot be inverted
+func invert3(m [3][3]float64) (inv [3][3]float64, ok bool) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if det == 0 {
+		return inv, false
+	}
+	inv[0][0] = (m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det
+	inv[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det
+	inv[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det
+	inv[1][0] = (m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det
+	inv[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det
+	inv[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det
+	inv[2][0] = (m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det
+	inv[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det
+	inv[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det
+	return inv, true
+}
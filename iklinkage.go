@@ -0,0 +1,211 @@
+package spotpuppy
+
+import (
+	"encoding/json"
+	"math"
+)
+
+func init() {
+	RegisterLegIK("linkage_knee", NewLinkageKneeIKGenerator())
+}
+
+// LinkageKneeIK is an IK driver for 3 jointed legs where the knee is driven by a servo at the hip, through a pushrod (a four-bar linkage).
+// The knee servo horn pivots at the hip joint, and the pushrod connects the end of the horn to a lever that is fixed to the lower bone at the knee.
+// All lengths and angles are measured in the plane of the leg, with angles going from forward towards down.
+// When all motors are at 0, the leg is in the same position as UnequalDirectMotorIK (the upper bone points 45 degrees forwards and down, and the knee is bent at 90 degrees)
+type LinkageKneeIK struct {
+	ReverseKneeJoint bool    `json:"reverse_knee_joint"`
+	ReverseHipXJoint bool    `json:"reverse_hip_x_joint"`
+	ReverseHipZJoint bool    `json:"reverse_hip_z_joint"`
+	FlipXAxis        bool    `json:"flip_x_axis"`
+	KneeOffset       float64 `json:"knee_offset"`
+	HipXOffset       float64 `json:"hip_x_offset"`
+	HipZOffset       float64 `json:"hip_z_offset"`
+	// HipZLimit, HipXLimit and KneeLimit are the ranges of each motor. If they are nil, the motor can move from -90 to 90
+	HipZLimit *JointLimit `json:"hip_z_limit"`
+	HipXLimit *JointLimit `json:"hip_x_limit"`
+	KneeLimit *JointLimit `json:"knee_limit"`
+	// UpperBoneLength is the length from the knee to the hip
+	UpperBoneLength float64 `json:"upper_bone_length"`
+	// LowerBoneLength is the length from the foot to the knee
+	LowerBoneLength float64 `json:"lower_bone_length"`
+	// HornLength is the length of the knee servo horn, from the hip to where the pushrod attaches
+	HornLength float64 `json:"horn_length"`
+	// PushrodLength is the length of the pushrod between the horn and the knee lever
+	PushrodLength float64 `json:"pushrod_length"`
+	// KneeLeverLength is the length of the lever on the lower bone, from the knee to where the pushrod attaches
+	KneeLeverLength float64 `json:"knee_lever_length"`
+	// KneeLeverAngle is the angle (in degrees) of the knee lever from the direction of the lower bone
+	KneeLeverAngle float64 `json:"knee_lever_angle"`
+	// KneeServoOnFemur should be true if the knee servo is fixed to the upper bone (so it turns with the hip x joint), or false if it is fixed to the body
+	KneeServoOnFemur bool `json:"knee_servo_on_femur"`
+	// CrossedLinkage should be true if the pushrod crosses over the upper bone (the linkage is a crossed four-bar), instead of running alongside it
+	CrossedLinkage bool `json:"crossed_linkage"`
+}
+
+// CalculateMotorRotations calculates the rotations of the three motors, and returns them in the order (hip left right, hip forwards backwords, knee)
+func (lk *LinkageKneeIK) CalculateMotorRotations(pos Vec3) []float64 {
+	return lk.SolveMotorRotations(pos).Rotations
+}
+
+// SolveMotorRotations calculates the rotations of the three motors, in the order (hip left right, hip forwards backwords, knee),
+// and reports whether the foot could reach pos
+func (lk *LinkageKneeIK) SolveMotorRotations(pos Vec3) IKResult {
+	if lk.FlipXAxis {
+		pos.X = -pos.X
+	}
+	// Generate angles for the leg, then find the knee servo angle that gives that knee angle
+	hzd, hxd, kneeAngle, inReach := solveTwoBoneLeg(pos, lk.UpperBoneLength, lk.LowerBoneLength)
+	kd, linkageOk := lk.hornAngle(hxd, kneeAngle)
+	inReach = inReach && linkageOk
+	restHorn, _ := lk.hornAngle(45, 90)
+	if lk.KneeServoOnFemur {
+		kd -= hxd - 45
+	}
+	// Make angles centered around 0
+	kd = wrapDegrees(kd - restHorn)
+	hxd = hxd - 45
+	hzd = hzd - 90
+	return newIKResult(lk, lk.motorMapping().toMotors(hzd, hxd, kd), lk.GetMotorLimits(), inReach)
+}
+
+// CalculateFootPosition calculates the position of the foot from the rotations of the three motors, in the order (hip left right, hip forwards backwords, knee)
+func (lk *LinkageKneeIK) CalculateFootPosition(rotations []float64) Vec3 {
+	hzd, hxd, kd := lk.motorMapping().fromMotors(rotations)
+	restHorn, _ := lk.hornAngle(45, 90)
+	kd += restHorn
+	hxd += 45
+	hzd += 90
+	if lk.KneeServoOnFemur {
+		kd += hxd - 45
+	}
+	// Find the knee angle that the horn angle gives, then follow the bones
+	kneeAngle, _ := lk.kneeAngle(hxd, kd)
+	pos := twoBoneLegFoot(hzd, hxd, kneeAngle, lk.UpperBoneLength, lk.LowerBoneLength)
+	if lk.FlipXAxis {
+		pos.X = -pos.X
+	}
+	return pos
+}
+
+// hornAngle finds the angle of the knee servo horn (from forward, in the plane of the leg) that bends the knee to kneeAngle when the upper bone is at upperAngle.
+// ok is false if the linkage cannot reach that knee angle
+func (lk *LinkageKneeIK) hornAngle(upperAngle, kneeAngle float64) (float64, bool) {
+	knee := planeDirection(upperAngle).Mul(lk.UpperBoneLength)
+	lever := knee.Add(planeDirection(upperAngle + 180 - kneeAngle + lk.KneeLeverAngle).Mul(lk.KneeLeverLength))
+	horn, otherHorn, ok := circleIntersections(Zero, lk.HornLength, lever, lk.PushrodLength)
+	if lk.isCrossed(lever, horn, knee) != lk.CrossedLinkage {
+		horn = otherHorn
+	}
+	return Degrees(math.Atan2(horn.Y, horn.X)), ok
+}
+
+// kneeAngle finds the angle inside the knee when the upper bone is at upperAngle and the knee servo horn is at hornAngle.
+// ok is false if the linkage cannot be put together at that horn angle
+func (lk *LinkageKneeIK) kneeAngle(upperAngle, hornAngle float64) (float64, bool) {
+	knee := planeDirection(upperAngle).Mul(lk.UpperBoneLength)
+	horn := planeDirection(hornAngle).Mul(lk.HornLength)
+	lever, otherLever, ok := circleIntersections(knee, lk.KneeLeverLength, horn, lk.PushrodLength)
+	if lk.isCrossed(lever, horn, knee) != lk.CrossedLinkage {
+		lever = otherLever
+	}
+	lowerAngle := Degrees(math.Atan2(lever.Y-knee.Y, lever.X-knee.X)) - lk.KneeLeverAngle
+	return wrapDegrees(upperAngle + 180 - lowerAngle), ok
+}
+
+// isCrossed returns true if the four-bar linkage (hip at the origin, horn end, lever end, knee) crosses over itself.
+// The linkage is not crossed when the horn end and the knee are on opposite sides of the line from the hip to the lever end
+func (lk *LinkageKneeIK) isCrossed(lever, horn, knee Vec3) bool {
+	return cross2(lever, horn)*cross2(lever, knee) > 0
+}
+
+func (lk *LinkageKneeIK) GetMotorNames() []string {
+	return directMotorIKNames
+}
+
+// motorMapping returns how the joint angles of this leg are reversed and offset to get motor rotations
+func (lk *LinkageKneeIK) motorMapping() motorMapping {
+	return motorMapping{
+		reverse: [3]bool{lk.ReverseHipZJoint, lk.ReverseHipXJoint, lk.ReverseKneeJoint},
+		offset:  [3]float64{lk.HipZOffset, lk.HipXOffset, lk.KneeOffset},
+	}
+}
+
+// GetMotorLimits returns the limits of the three motors, in the order (hip left right, hip forwards backwords, knee)
+func (lk *LinkageKneeIK) GetMotorLimits() []JointLimit {
+	return []JointLimit{jointLimitOrDefault(lk.HipZLimit), jointLimitOrDefault(lk.HipXLimit), jointLimitOrDefault(lk.KneeLimit)}
+}
+
+// GetRestingPosition returns the position where all of the joints are at 0 degrees
+func (lk *LinkageKneeIK) GetRestingPosition() Vec3 {
+	pos := twoBoneLegFoot(90, 45, 90, lk.UpperBoneLength, lk.LowerBoneLength)
+	if lk.FlipXAxis {
+		pos.X = -pos.X
+	}
+	return pos
+}
+
+// Loads json data into this object
+func (lk *LinkageKneeIK) LoadJson(data []byte) error {
+	return json.Unmarshal(data, lk)
+}
+
+// NewLinkageKneeIKGenerator creates a function to create empty LinkageKneeIK structs. This is used by robot to create a seperate controller for each leg.
+// The default linkage is a parallelogram, so the horn turns by the same amount as the lower bone
+func NewLinkageKneeIKGenerator() func() LegIK {
+	return func() LegIK {
+		return &LinkageKneeIK{
+			ReverseKneeJoint: false,
+			ReverseHipXJoint: false,
+			ReverseHipZJoint: false,
+			FlipXAxis:        false,
+			KneeOffset:       0,
+			HipXOffset:       0,
+			HipZOffset:       0,
+			HipZLimit:        NewJointLimit(-90, 90),
+			HipXLimit:        NewJointLimit(-90, 90),
+			KneeLimit:        NewJointLimit(-90, 90),
+			UpperBoneLength:  6,
+			LowerBoneLength:  6,
+			HornLength:       1.5,
+			PushrodLength:    6,
+			KneeLeverLength:  1.5,
+			KneeLeverAngle:   180,
+			KneeServoOnFemur: false,
+			CrossedLinkage:   false,
+		}
+	}
+}
+
+// planeDirection returns the unit vector at angle (in degrees) from forward in the plane of a leg, using X as forward and Y as down the leg
+func planeDirection(angle float64) Vec3 {
+	return NewVector3(math.Cos(Radians(angle)), math.Sin(Radians(angle)), 0)
+}
+
+// cross2 returns the Z component of the cross product of two vectors in the XY plane
+func cross2(a, b Vec3) float64 {
+	return a.X*b.Y - a.Y*b.X
+}
+
+// circleIntersections finds the two points where circles in the XY plane meet. If they do not meet, ok is false and the two closest points are returned instead
+func circleIntersections(c1 Vec3, r1 float64, c2 Vec3, r2 float64) (p1, p2 Vec3, ok bool) {
+	between := c2.Sub(c1)
+	d := between.Len()
+	if d == 0 {
+		return c1.Add(Forward.Mul(r1)), c1.Add(Forward.Mul(r1)), r1 == r2
+	}
+	dir := between.Mul(1 / d)
+	a := (r1*r1 - r2*r2 + d*d) / (2 * d)
+	h2 := r1*r1 - a*a
+	ok = h2 >= 0
+	a = clamp(a, -r1, r1)
+	h := math.Sqrt(math.Max(h2, 0))
+	perp := NewVector3(-dir.Y, dir.X, 0)
+	mid := c1.Add(dir.Mul(a))
+	return mid.Add(perp.Mul(h)), mid.Sub(perp.Mul(h)), ok
+}
+
+// wrapDegrees wraps an angle into the range -180 to 180
+func wrapDegrees(angle float64) float64 {
+	return angle - 360*math.Floor((angle+180)/360)
+}
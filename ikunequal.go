@@ -0,0 +1,141 @@
+package spotpuppy
+
+import (
+	"encoding/json"
+	"math"
+)
+
+func init() {
+	RegisterLegIK("unequal_direct_motor", NewUnequalDirectMotorIKGenerator())
+}
+
+// UnequalDirectMotorIK is an IK driver for 3 jointed legs (like Spot Mini), with one motor at each joint (no control rods or gears).
+// Unlike DirectMotorIK, the distance from knee to hip (upper bone) can be different to the distance from foot to knee (lower bone).
+// When all motors are at 0, the upper bone points 45 degrees forwards and down, and the knee is bent at 90 degrees
+type UnequalDirectMotorIK struct {
+	ReverseKneeJoint bool    `json:"reverse_knee_joint"`
+	ReverseHipXJoint bool    `json:"reverse_hip_x_joint"`
+	ReverseHipZJoint bool    `json:"reverse_hip_z_joint"`
+	FlipXAxis        bool    `json:"flip_x_axis"`
+	KneeOffset       float64 `json:"knee_offset"`
+	HipXOffset       float64 `json:"hip_x_offset"`
+	HipZOffset       float64 `json:"hip_z_offset"`
+	// HipZLimit, HipXLimit and KneeLimit are the ranges of each motor. If they are nil, the motor can move from -90 to 90
+	HipZLimit *JointLimit `json:"hip_z_limit"`
+	HipXLimit *JointLimit `json:"hip_x_limit"`
+	KneeLimit *JointLimit `json:"knee_limit"`
+	// UpperBoneLength is the length from the knee to the hip
+	UpperBoneLength float64 `json:"upper_bone_length"`
+	// LowerBoneLength is the length from the foot to the knee
+	LowerBoneLength float64 `json:"lower_bone_length"`
+}
+
+// CalculateMotorRotations calculates the rotations of the three motors, and returns them in the order (hip left right, hip forwards backwords, knee)
+func (um *UnequalDirectMotorIK) CalculateMotorRotations(pos Vec3) []float64 {
+	return um.SolveMotorRotations(pos).Rotations
+}
+
+// SolveMotorRotations calculates the rotations of the three motors, in the order (hip left right, hip forwards backwords, knee),
+// and reports whether the foot could reach pos
+func (um *UnequalDirectMotorIK) SolveMotorRotations(pos Vec3) IKResult {
+	if um.FlipXAxis {
+		pos.X = -pos.X
+	}
+	// Generate angles
+	hzd, hxd, kd, inReach := solveTwoBoneLeg(pos, um.UpperBoneLength, um.LowerBoneLength)
+	// Make angles centered around 0
+	kd = kd - 90
+	hxd = hxd - 45
+	hzd = hzd - 90
+	return newIKResult(um, um.motorMapping().toMotors(hzd, hxd, kd), um.GetMotorLimits(), inReach)
+}
+
+// CalculateFootPosition calculates the position of the foot from the rotations of the three motors, in the order (hip left right, hip forwards backwords, knee)
+func (um *UnequalDirectMotorIK) CalculateFootPosition(rotations []float64) Vec3 {
+	hzd, hxd, kd := um.motorMapping().fromMotors(rotations)
+	kd += 90
+	hxd += 45
+	hzd += 90
+	pos := twoBoneLegFoot(hzd, hxd, kd, um.UpperBoneLength, um.LowerBoneLength)
+	if um.FlipXAxis {
+		pos.X = -pos.X
+	}
+	return pos
+}
+
+// solveTwoBoneLeg finds the angles (in degrees) for a leg with an upper and lower bone to reach pos.
+// plane is the angle of the plane of the leg around the forward axis (90 is straight down), upperAngle is the angle of the upper bone from forward in that plane,
+// and knee is the angle inside the knee. inReach is false if the foot is too far away or too close to reach
+func solveTwoBoneLeg(pos Vec3, upper, lower float64) (plane, upperAngle, knee float64, inReach bool) {
+	// Keep the foot within the range that the two bones can reach
+	dist := clamp(pos.Len(), math.Abs(upper-lower), upper+lower)
+	inReach = dist == pos.Len()
+	// The upper bone works in the plane that the hip z joint has rotated the leg into
+	knee = triangleDegrees(upper, lower, dist)
+	upperAngle = Degrees(math.Atan2(math.Sqrt(pos.Y*pos.Y+pos.Z*pos.Z), pos.X))
+	if dist > 0 {
+		upperAngle -= triangleDegrees(upper, dist, lower)
+	}
+	plane = Degrees(math.Atan2(pos.Y, pos.Z))
+	return plane, upperAngle, knee, inReach
+}
+
+// twoBoneLegFoot is the inverse of solveTwoBoneLeg. It finds the foot in the plane of the leg by following the bones, then rotates that plane around the forward axis
+func twoBoneLegFoot(plane, upperAngle, knee, upper, lower float64) Vec3 {
+	lowerAngle := Radians(upperAngle + 180 - knee)
+	fwd := upper*math.Cos(Radians(upperAngle)) + lower*math.Cos(lowerAngle)
+	inPlane := upper*math.Sin(Radians(upperAngle)) + lower*math.Sin(lowerAngle)
+	return NewVector3(fwd, inPlane*math.Sin(Radians(plane)), inPlane*math.Cos(Radians(plane)))
+}
+
+// triangleDegrees uses the cosine rule to find the angle between sides a and b of a triangle, where c is the opposite side
+func triangleDegrees(a, b, c float64) float64 {
+	return Degrees(math.Acos(clamp((a*a+b*b-c*c)/(2*a*b), -1, 1)))
+}
+
+func (um *UnequalDirectMotorIK) GetMotorNames() []string {
+	return directMotorIKNames
+}
+
+// motorMapping returns how the joint angles of this leg are reversed and offset to get motor rotations
+func (um *UnequalDirectMotorIK) motorMapping() motorMapping {
+	return motorMapping{
+		reverse: [3]bool{um.ReverseHipZJoint, um.ReverseHipXJoint, um.ReverseKneeJoint},
+		offset:  [3]float64{um.HipZOffset, um.HipXOffset, um.KneeOffset},
+	}
+}
+
+// GetMotorLimits returns the limits of the three motors, in the order (hip left right, hip forwards backwords, knee)
+func (um *UnequalDirectMotorIK) GetMotorLimits() []JointLimit {
+	return []JointLimit{jointLimitOrDefault(um.HipZLimit), jointLimitOrDefault(um.HipXLimit), jointLimitOrDefault(um.KneeLimit)}
+}
+
+// GetRestingPosition returns the position where all of the joints are at 0 degrees
+func (um *UnequalDirectMotorIK) GetRestingPosition() Vec3 {
+	return um.CalculateFootPosition([]float64{um.HipZOffset, um.HipXOffset, um.KneeOffset})
+}
+
+// Loads json data into this object
+func (um *UnequalDirectMotorIK) LoadJson(data []byte) error {
+	return json.Unmarshal(data, um)
+}
+
+// NewUnequalDirectMotorIKGenerator creates a function to create empty UnequalDirectMotorIK structs. This is used by robot to create a seperate controller for each leg
+func NewUnequalDirectMotorIKGenerator() func() LegIK {
+	return func() LegIK {
+		return &UnequalDirectMotorIK{
+			ReverseKneeJoint: false,
+			ReverseHipXJoint: false,
+			ReverseHipZJoint: false,
+			FlipXAxis:        false,
+			KneeOffset:       0,
+			HipXOffset:       0,
+			HipZOffset:       0,
+			HipZLimit:        NewJointLimit(-90, 90),
+			HipXLimit:        NewJointLimit(-90, 90),
+			KneeLimit:        NewJointLimit(-90, 90),
+			UpperBoneLength:  6,
+			LowerBoneLength:  6,
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package spotpuppy
+
+import (
+	"math"
+	"sync"
+)
+
+func init() {
+	RegisterOrientationFilter("kalman", func() OrientationFilter { return NewKalmanFilter() })
+}
+
+// KalmanFilter is an extended Kalman filter that tracks the orientation of the sensor and the bias of the gyro together, so it keeps level even when the gyro bias drifts (for example, as the sensor warms up).
+// It also tracks how certain it is of both, which can be read with Covariance and TiltUncertainty.
+// The state is the orientation and bias, and the filter works on small errors of each (an error-state, or multiplicative, EKF).
+// It is safe to read the estimates from another goroutine while the filter is updating
+type KalmanFilter struct {
+	// GyroNoise is the standard deviation of the noise on each gyro reading, in deg/s
+	GyroNoise float64 `json:"gyro_noise"`
+	// BiasDrift is how quickly the gyro bias can drift, in deg/s per second
+	BiasDrift float64 `json:"bias_drift"`
+	// AccelNoise is the standard deviation of the noise on the direction of each accelerometer reading (as a fraction of its length).
+	// Larger values trust the accelerometer less, which helps when the robot is accelerating a lot
+	AccelNoise float64 `json:"accel_noise"`
+	// InitialTiltUncertainty and InitialBiasUncertainty are the standard deviations of the orientation (in degrees) and gyro bias (in deg/s) when the filter is reset
+	InitialTiltUncertainty float64 `json:"initial_tilt_uncertainty"`
+	InitialBiasUncertainty float64 `json:"initial_bias_uncertainty"`
+	mu                     sync.Mutex
+	orientation            Quat
+	// bias is in radians per second
+	bias Vec3
+	// covariance is of the errors (orientation error in radians, in the space of the sensor, then bias error in radians per second)
+	covariance mat6
+}
+
+// mat6 is a 6x6 matrix
+type mat6 [6][6]float64
+
+// NewKalmanFilter creates a new Kalman filter, with settings that suit an MPU6050
+func NewKalmanFilter() *KalmanFilter {
+	k := &KalmanFilter{
+		GyroNoise:              0.3,
+		BiasDrift:              0.1,
+		AccelNoise:             0.05,
+		InitialTiltUncertainty: 30,
+		InitialBiasUncertainty: 2,
+	}
+	k.Reset()
+	return k
+}
+
+// Update predicts the new orientation with the gyro (minus the estimated bias), then corrects the orientation and bias with the accelerometer
+func (k *KalmanFilter) Update(gyro, accel Vec3, dt float64) Quat {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.predict(gyro, dt)
+	if accel.Len() != 0 {
+		k.correct(accel.Unit())
+	}
+	return k.orientation
+}
+
+// Reset sets the orientation back to QuatIdentity, forgets the gyro bias, and sets the covariance back to its initial uncertainty
+func (k *KalmanFilter) Reset() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.orientation = QuatIdentity
+	k.bias = Zero
+	k.covariance = mat6{}
+	for i := 0; i < 3; i++ {
+		k.covariance[i][i] = math.Pow(Radians(k.InitialTiltUncertainty), 2)
+		k.covariance[i+3][i+3] = math.Pow(Radians(k.InitialBiasUncertainty), 2)
+	}
+}
+
+// Orientation returns the current estimate of the orientation
+func (k *KalmanFilter) Orientation() Quat {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.orientation
+}
+
+// Bias returns the current estimate of the gyro bias, in deg/s. This has already been removed from the gyro readings
+func (k *KalmanFilter) Bias() Vec3 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.bias.Mul(Degrees(1))
+}
+
+// Covariance returns the covariance of the error of the estimate. The first three rows and columns are the orientation error around each axis of the sensor (in degrees),
+// and the last three are the gyro bias error (in deg/s). The square root of a value on the diagonal is the standard deviation of that part of the estimate
+func (k *KalmanFilter) Covariance() [6][6]float64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	scale := Degrees(1) * Degrees(1)
+	c := [6][6]float64{}
+	for i := range c {
+		for j := range c[i] {
+			c[i][j] = k.covariance[i][j] * scale
+		}
+	}
+	return c
+}
+
+// TiltUncertainty returns the standard deviation (in degrees) of the estimate of which way is up. This does not include yaw, which the accelerometer cannot correct.
+// Control code can use this to decide how much to trust the orientation
+func (k *KalmanFilter) TiltUncertainty() float64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// Only the parts of the orientation error that are perpendicular to up tilt the sensor
+	up := Up.Rotated(k.orientation.Inv())
+	u := [3]float64{up.X, up.Y, up.Z}
+	variance := 0.0
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			projection := -u[i] * u[j]
+			if i == j {
+				projection++
+			}
+			variance += projection * k.covariance[i][j]
+		}
+	}
+	return Degrees(math.Sqrt(math.Max(variance, 0)))
+}
+
+// predict turns the orientation by the gyro reading (minus the bias), and grows the covariance by the gyro noise and bias drift
+func (k *KalmanFilter) predict(gyro Vec3, dt float64) {
+	w := gyro.Mul(Radians(1)).Sub(k.bias)
+	k.orientation = integrateGyro(k.orientation, w.Mul(Degrees(1)), dt)
+	// The orientation error is rotated by the opposite of the gyro, and grows by the bias error
+	f := identity6()
+	skew := skew3(w)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			f[i][j] -= skew[i][j] * dt
+		}
+		f[i][i+3] = -dt
+	}
+	k.covariance = f.mul(k.covariance).mul(f.transpose())
+	gyroVar := math.Pow(Radians(k.GyroNoise)*dt, 2)
+	biasVar := math.Pow(Radians(k.BiasDrift)*dt, 2)
+	for i := 0; i < 3; i++ {
+		k.covariance[i][i] += gyroVar
+		k.covariance[i+3][i+3] += biasVar
+	}
+}
+
+// correct compares the measured up direction (from the accelerometer) to the up direction expected from the orientation, and corrects the orientation, bias and covariance
+func (k *KalmanFilter) correct(measuredUp Vec3) {
+	expectedUp := Up.Rotated(k.orientation.Inv())
+	// A small orientation error e changes the expected up by expectedUp x e, so the measurement matrix is [skew(expectedUp) 0]
+	h := skew3(expectedUp)
+	// s = H P H^T + R
+	var ph [6][3]float64
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 3; j++ {
+			for m := 0; m < 3; m++ {
+				ph[i][j] += k.covariance[i][m] * h[j][m]
+			}
+		}
+	}
+	var s [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for m := 0; m < 3; m++ {
+				s[i][j] += h[i][m] * ph[m][j]
+			}
+		}
+		s[i][i] += k.AccelNoise * k.AccelNoise
+	}
+	sInv, ok := invert3(s)
+	if !ok {
+		return
+	}
+	// gain = P H^T S^-1
+	var gain [6][3]float64
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 3; j++ {
+			for m := 0; m < 3; m++ {
+				gain[i][j] += ph[i][m] * sInv[m][j]
+			}
+		}
+	}
+	innovation := measuredUp.Sub(expectedUp)
+	y := [3]float64{innovation.X, innovation.Y, innovation.Z}
+	var dx [6]float64
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 3; j++ {
+			dx[i] += gain[i][j] * y[j]
+		}
+	}
+	// Apply the error to the orientation (in the space of the sensor) and the bias
+	k.orientation = integrateGyro(k.orientation, NewVector3(dx[0], dx[1], dx[2]).Mul(Degrees(1)), 1)
+	k.bias = k.bias.Add(NewVector3(dx[3], dx[4], dx[5]))
+	// P = (I - K H) P, where only the first three columns of H are not zero
+	ikh := identity6()
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 3; j++ {
+			for m := 0; m < 3; m++ {
+				ikh[i][j] -= gain[i][m] * h[m][j]
+			}
+		}
+	}
+	k.covariance = ikh.mul(k.covariance).symmetric()
+}
+
+// identity6 returns the 6x6 identity matrix
+func identity6() mat6 {
+	m := mat6{}
+	for i := range m {
+		m[i][i] = 1
+	}
+	return m
+}
+
+// mul returns the matrix product m * n
+func (m mat6) mul(n mat6) mat6 {
+	r := mat6{}
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 6; j++ {
+			for k := 0; k < 6; k++ {
+				r[i][j] += m[i][k] * n[k][j]
+			}
+		}
+	}
+	return r
+}
+
+// transpose returns the transpose of m
+func (m mat6) transpose() mat6 {
+	r := mat6{}
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 6; j++ {
+			r[i][j] = m[j][i]
+		}
+	}
+	return r
+}
+
+// symmetric returns m averaged with its transpose, which removes rounding errors from a covariance matrix
+func (m mat6) symmetric() mat6 {
+	r := mat6{}
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 6; j++ {
+			r[i][j] = (m[i][j] + m[j][i]) / 2
+		}
+	}
+	return r
+}
+
+// skew3 returns the matrix that does the cross product with v, so skew3(v) * u = v x u
+func skew3(v Vec3) [3][3]float64 {
+	return [3][3]float64{
+		{0, -v.Z, v.Y},
+		{v.Z, 0, -v.X},
+		{-v.Y, v.X, 0},
+	}
+}
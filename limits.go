@@ -0,0 +1,65 @@
+package spotpuppy
+
+import "math"
+
+// JointLimit is the range of motor rotations (in degrees) that a joint can move through before hitting its mechanical stops
+type JointLimit struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	// SoftRange is the number of degrees before each stop where the joint starts to slow down.
+	// Inside this range, the joint moves less and less as the rotation goes further towards the stop, so it never slams into it. 0 disables soft limits
+	SoftRange float64 `json:"soft_range"`
+}
+
+// LimitedLegIK describes LegIK types that can report the range of each of their motors
+type LimitedLegIK interface {
+	LegIK
+	// GetMotorLimits returns a limit for each motor, in the same order as GetMotorNames
+	GetMotorLimits() []JointLimit
+}
+
+// DefaultJointLimit is the full range that a MotorController accepts, with no soft limits
+var DefaultJointLimit = JointLimit{Min: -90, Max: 90}
+
+// NewJointLimit creates a JointLimit between min and max, with no soft limits
+func NewJointLimit(min, max float64) *JointLimit {
+	return &JointLimit{Min: min, Max: max}
+}
+
+// Limit applies the soft limits then the hard limits to a rotation
+func (j JointLimit) Limit(angle float64) float64 {
+	soft := math.Min(j.SoftRange, (j.Max-j.Min)/2)
+	if soft > 0 {
+		if lower := j.Min + soft; angle < lower {
+			angle = lower - soft*math.Tanh((lower-angle)/soft)
+		} else if upper := j.Max - soft; angle > upper {
+			angle = upper + soft*math.Tanh((angle-upper)/soft)
+		}
+	}
+	return j.Clamp(angle)
+}
+
+// Clamp applies only the hard limits to a rotation
+func (j JointLimit) Clamp(angle float64) float64 {
+	return clamp(angle, j.Min, j.Max)
+}
+
+// jointLimitOrDefault returns the limit, or DefaultJointLimit if it is nil
+func jointLimitOrDefault(limit *JointLimit) JointLimit {
+	if limit == nil {
+		return DefaultJointLimit
+	}
+	return *limit
+}
+
+// getMotorLimits returns the limits of each motor of a LegIK. If the LegIK is not a LimitedLegIK, every motor has the DefaultJointLimit
+func getMotorLimits(ik LegIK) []JointLimit {
+	if lik, ok := ik.(LimitedLegIK); ok {
+		return lik.GetMotorLimits()
+	}
+	limits := make([]JointLimit, len(ik.GetMotorNames()))
+	for i := range limits {
+		limits[i] = DefaultJointLimit
+	}
+	return limits
+}
@@ -0,0 +1,94 @@
+package spotpuppy
+
+import (
+	"errors"
+	"math"
+)
+
+// MagCalibration corrects the readings of a magnetometer for the magnetic fields of the robot itself. A calibrated magnetometer reads the same strength in every direction
+type MagCalibration struct {
+	// HardIron is the field of magnets on the robot (like the motors), which turn with the robot so add the same offset to every reading. It is taken away from each reading
+	HardIron Vec3 `json:"hard_iron"`
+	// SoftIron bends the earth's field back into shape after iron on the robot has stretched it. Each reading is multiplied by this matrix after HardIron is taken away.
+	// If it is all zeros, it is not used
+	SoftIron [3][3]float64 `json:"soft_iron"`
+}
+
+// Apply returns a raw magnetometer reading with the calibration applied
+func (c MagCalibration) Apply(raw Vec3) Vec3 {
+	v := raw.Sub(c.HardIron)
+	if c.SoftIron == ([3][3]float64{}) {
+		return v
+	}
+	m := c.SoftIron
+	return NewVector3(
+		m[0][0]*v.X+m[0][1]*v.Y+m[0][2]*v.Z,
+		m[1][0]*v.X+m[1][1]*v.Y+m[1][2]*v.Z,
+		m[2][0]*v.X+m[2][1]*v.Y+m[2][2]*v.Z,
+	)
+}
+
+// FitMagCalibration finds the calibration of a magnetometer from raw readings taken while the robot was turned to face as many different directions as possible (including upside down).
+// It fits a stretched sphere (aligned with the axes of the magnetometer) to the readings, so HardIron is its center, and SoftIron scales each axis to the average radius
+func FitMagCalibration(samples []Vec3) (MagCalibration, error) {
+	if len(samples) < 6 {
+		return MagCalibration{}, errors.New("at least 6 magnetometer readings are needed for calibration")
+	}
+	center, radii, ok := fitEllipsoid(samples)
+	if !ok {
+		return MagCalibration{}, errors.New("magnetometer readings do not cover enough directions for calibration")
+	}
+	average := (radii.X + radii.Y + radii.Z) / 3
+	c := MagCalibration{HardIron: center}
+	c.SoftIron[0][0] = average / radii.X
+	c.SoftIron[1][1] = average / radii.Y
+	c.SoftIron[2][2] = average / radii.Z
+	return c, nil
+}
+
+// MagneticHeading turns the yaw of an orientation towards the heading measured by a magnetometer, so that the yaw does not drift, and the orientation faces Forward when the robot faces north.
+// It only turns the orientation around Up, so magnetic noise cannot tilt the orientation. It can be used after any OrientationFilter
+type MagneticHeading struct {
+	// Gain is how quickly the heading is turned towards the magnetometer, per second. Larger values follow the magnetometer more closely, but let through more magnetic noise from the motors
+	Gain float64 `json:"gain"`
+	// Declination is how many degrees east of true north magnetic north is where the robot is. If it is 0, headings are measured from magnetic north
+	Declination float64 `json:"declination"`
+	// offset is the rotation (in degrees around Up) added to the orientation
+	offset  float64
+	started bool
+}
+
+// NewMagneticHeading creates a new MagneticHeading with a gain of 0.5
+func NewMagneticHeading() *MagneticHeading {
+	return &MagneticHeading{
+		Gain: 0.5,
+	}
+}
+
+// Update takes an orientation (from an OrientationFilter), the calibrated magnetometer reading (in any units, in the space of the sensor), and the time in seconds since the last update.
+// It returns the orientation turned to face north. The first update turns straight to the magnetometer's heading
+func (h *MagneticHeading) Update(orientation Quat, mag Vec3, dt float64) Quat {
+	corrected := orientation.RotateByGlobal(NewQuatAngleAxis(Up, h.offset))
+	// Tilt compensation: rotate the reading into global space with the corrected orientation, then only keep the part along the ground, which points to magnetic north
+	north := mag.Rotated(corrected).ProjectToPlane(Up)
+	if north.Len() == 0 {
+		return corrected
+	}
+	// Magnetic north should be Declination degrees clockwise (when looking down) from Forward, which is true north
+	northAngle := Degrees(math.Atan2(north.Z, north.X))
+	err := wrapDegrees(northAngle + h.Declination)
+	if !h.started {
+		h.offset -= err
+		h.started = true
+	} else {
+		h.offset -= err * math.Min(1, h.Gain*dt)
+	}
+	h.offset = wrapDegrees(h.offset)
+	return orientation.RotateByGlobal(NewQuatAngleAxis(Up, h.offset))
+}
+
+// Reset forgets the heading, so the next update turns straight to the magnetometer's heading
+func (h *MagneticHeading) Reset() {
+	h.offset = 0
+	h.started = false
+}
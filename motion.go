@@ -0,0 +1,193 @@
+package spotpuppy
+
+// Easing maps how far through a motion we are (from 0 to 1) to how far the legs should have moved (from 0 to 1)
+type Easing func(t float64) float64
+
+// EaseLinear moves the legs at a constant speed
+func EaseLinear(t float64) float64 {
+	return clamp(t, 0, 1)
+}
+
+// EaseCubic speeds the legs up at the start of the motion and slows them down at the end
+func EaseCubic(t float64) float64 {
+	t = clamp(t, 0, 1)
+	return t * t * (3 - 2*t)
+}
+
+// EaseMinimumJerk is the smoothest easing, with zero velocity and acceleration at both ends. This is the kindest to servos
+func EaseMinimumJerk(t float64) float64 {
+	return quintic(t)
+}
+
+// Motion is a smooth movement of some legs (and optionally the body pose) from wherever they are when the motion starts to a set of targets
+type Motion struct {
+	// Legs is the target for each leg. Legs that are not in the map do not move
+	Legs map[string]Vec3
+	// WorldSpace should be true if Legs are foot positions in world space (like SetFootPosition), or false if they are relative to each shoulder (like SetLegPosition)
+	WorldSpace bool
+	// BodyPose is the target body pose. If it is nil, the body pose is not changed
+	BodyPose *BodyPose
+	// Duration is how long (in seconds) the motion takes
+	Duration float64
+	// Easing changes how the legs speed up and slow down. If it is nil, EaseLinear is used
+	Easing        Easing
+	startLegs     map[string]Vec3
+	startBodyPose BodyPose
+	elapsed       float64
+	done          chan struct{}
+	// queued is how many times the motion is waiting in the queue of a MotionPlayer
+	queued    int
+	started   bool
+	finished  bool
+	cancelled bool
+}
+
+// NewMotion creates a motion that moves the legs (relative to their shoulders, like SetLegPosition) to the targets over duration seconds
+func NewMotion(legs map[string]Vec3, duration float64, easing Easing) *Motion {
+	return &Motion{
+		Legs:     legs,
+		Duration: duration,
+		Easing:   easing,
+		done:     make(chan struct{}),
+	}
+}
+
+// Done returns a channel that is closed when the motion finishes, or is cancelled by MotionPlayer.Clear
+func (m *Motion) Done() <-chan struct{} {
+	return m.done
+}
+
+// IsFinished returns true if the motion has finished, or was cancelled by MotionPlayer.Clear
+func (m *Motion) IsFinished() bool {
+	return m.finished
+}
+
+// IsCancelled returns true if the motion was removed by MotionPlayer.Clear before it could finish
+func (m *Motion) IsCancelled() bool {
+	return m.cancelled
+}
+
+// start records where the legs and body are when the motion starts
+func (m *Motion) start(q *LeggedRobot) {
+	m.startLegs = make(map[string]Vec3)
+	for l := range m.Legs {
+		if m.WorldSpace {
+			m.startLegs[l] = q.GetFootPosition(l)
+		} else {
+			m.startLegs[l] = q.GetLegPosition(l)
+		}
+	}
+	m.startBodyPose = q.GetBodyPose()
+	m.started = true
+}
+
+// apply moves the legs and body of the quadruped to where they should be after the motion has run for elapsed seconds
+func (m *Motion) apply(q *LeggedRobot) {
+	t := 1.0
+	if m.Duration > 0 {
+		t = m.elapsed / m.Duration
+	}
+	if m.Easing == nil {
+		t = EaseLinear(t)
+	} else {
+		t = m.Easing(t)
+	}
+	if m.BodyPose != nil {
+		q.SetBodyPose(NewBodyPose(
+			m.startBodyPose.Position.Add(m.BodyPose.Position.Sub(m.startBodyPose.Position).Mul(t)),
+			m.startBodyPose.Rotation.Slerp(m.BodyPose.rotation(), t),
+		))
+	}
+	for l, target := range m.Legs {
+		pos := m.startLegs[l].Add(target.Sub(m.startLegs[l]).Mul(t))
+		if m.WorldSpace {
+			q.SetFootPosition(l, pos)
+		} else {
+			q.SetLegPosition(l, pos)
+		}
+	}
+}
+
+// finish takes the motion out of the queue once. If it is queued again, it is reset so that it can play again.
+// Otherwise it is marked as finished (or cancelled), and Done is closed
+func (m *Motion) finish(cancelled bool) {
+	m.queued--
+	m.started = false
+	m.elapsed = 0
+	m.cancelled = m.cancelled || cancelled
+	if m.queued > 0 {
+		return
+	}
+	m.finished = true
+	close(m.done)
+}
+
+// MotionPlayer plays a queue of motions on a quadruped, one after the other. Each motion starts from wherever the legs are when the previous motion finishes
+type MotionPlayer struct {
+	robot *LeggedRobot
+	queue []*Motion
+}
+
+// NewMotionPlayer creates a new motion player for a quadruped
+func NewMotionPlayer(q *LeggedRobot) *MotionPlayer {
+	return &MotionPlayer{
+		robot: q,
+		queue: make([]*Motion, 0),
+	}
+}
+
+// Queue adds a motion to the end of the queue, and returns it so that it can be waited on.
+// A motion that has finished can be queued again, and a motion can be queued more than once, in which case it finishes after its last play
+func (p *MotionPlayer) Queue(m *Motion) *Motion {
+	if m.done == nil || m.finished {
+		// The motion is new, or is playing again, so it needs a new Done channel
+		m.done = make(chan struct{})
+		m.started = false
+		m.elapsed = 0
+		m.finished = false
+		m.cancelled = false
+	}
+	m.queued++
+	p.queue = append(p.queue, m)
+	return m
+}
+
+// MoveTo queues a motion that moves the legs (relative to their shoulders, like SetLegPosition) to the targets over duration seconds
+func (p *MotionPlayer) MoveTo(legs map[string]Vec3, duration float64, easing Easing) *Motion {
+	return p.Queue(NewMotion(legs, duration, easing))
+}
+
+// Update runs the motions forwards by dt seconds, and sets the leg positions (and body pose) of the quadruped.
+// If a motion finishes part way through dt, the rest of dt is used by the next motion
+func (p *MotionPlayer) Update(dt float64) {
+	for len(p.queue) > 0 {
+		m := p.queue[0]
+		if !m.started {
+			m.start(p.robot)
+		}
+		m.elapsed += dt
+		m.apply(p.robot)
+		if m.elapsed < m.Duration {
+			return
+		}
+		dt = m.elapsed - m.Duration
+		m.finish(false)
+		p.queue = p.queue[1:]
+		if dt <= 0 {
+			return
+		}
+	}
+}
+
+// IsIdle returns true if there are no motions playing or queued
+func (p *MotionPlayer) IsIdle() bool {
+	return len(p.queue) == 0
+}
+
+// Clear stops the current motion, and removes all queued motions. The legs stay where they are, and the removed motions are cancelled (so Done is closed)
+func (p *MotionPlayer) Clear() {
+	for _, m := range p.queue {
+		m.finish(true)
+	}
+	p.queue = p.queue[:0]
+}
@@ -1,5 +1,9 @@
 package spotpuppy
 
+func init() {
+	RegisterMotorController("dummy", func() MotorController { return NewDummyMotorController() })
+}
+
 // MotorController is an interface type to allow setting of positions to named motors
 type MotorController interface {
 	// SetMotor allows setting of a named motor to an angle between -90 to 90
@@ -7,8 +11,9 @@ type MotorController interface {
 	// CreateMotorMapping is for initialising any motor mapping that is stored with all possible motor names
 	CreateMotorMapping([]string)
 	// Setup is called once the motor controller has a motor mapping set up and has been loaded from a file.
-	// This could be used, for example, to create a servo object for each item in the mapping
-	Setup()
+	// This could be used, for example, to create a servo object for each item in the mapping.
+	// It should return an error if the hardware could not be set up, instead of panicking
+	Setup() error
 	// CalibrateAllJoints is called to calibrate all joint positions. It can block until complete. It is only useful for brushless motors, not servos.
 	CalibrateAllJoints()
 }
@@ -37,8 +42,8 @@ func (d *DummyMotorController) CreateMotorMapping(names []string) {
 }
 
 // Setup does nothing for DummyMotorController
-func (d *DummyMotorController) Setup() {
-
+func (d *DummyMotorController) Setup() error {
+	return nil
 }
 
 func (d *DummyMotorController) CalibrateAllJoints() {
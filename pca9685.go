@@ -1,10 +1,16 @@
 package spotpuppy
 
 import (
+	"fmt"
+
 	"github.com/googolgl/go-i2c"
 	"github.com/googolgl/go-pca9685"
 )
 
+func init() {
+	RegisterMotorController("pca9685", func() MotorController { return newUnconnectedPCAMotorController() })
+}
+
 type PCAMotorController struct {
 	ServoOptions *pca9685.ServOptions `json:"servo-options"`
 	Mapping      map[string]int       `json:"mapping"`
@@ -23,28 +29,41 @@ func (d *PCAMotorController) CreateMotorMapping(names []string) {
 	}
 }
 
-func (d *PCAMotorController) Setup() {
+// Setup connects to the pca9685 (if it is not already connected), and creates a servo for each motor in the mapping
+func (d *PCAMotorController) Setup() error {
+	if d.pca == nil {
+		pca, err := connectPCA9685()
+		if err != nil {
+			return err
+		}
+		d.pca = pca
+	}
 	d.servos = make(map[string]*pca9685.Servo)
 	for k, v := range d.Mapping {
 		d.servos[k] = d.pca.ServoNew(v, d.ServoOptions)
 	}
+	return nil
 }
 
 func (d *PCAMotorController) CalibrateAllJoints() {
 	// No calibration is needed as servos always are at the correct position
 }
 
-func NewPCAMotorController() *PCAMotorController {
-	i2c, err := i2c.New(pca9685.Address, "/dev/i2c-1")
+// NewPCAMotorController creates a new PCAMotorController and connects to the pca9685 on /dev/i2c-1.
+// It returns an error if i2c or the pca9685 could not be found
+func NewPCAMotorController() (*PCAMotorController, error) {
+	pca, err := connectPCA9685()
 	if err != nil {
-		panic("Could not connect to i2c")
-	}
-	pca0, err := pca9685.New(i2c, nil)
-	if err != nil {
-		panic("Could not connect to pca9685")
+		return nil, err
 	}
+	d := newUnconnectedPCAMotorController()
+	d.pca = pca
+	return d, nil
+}
+
+// newUnconnectedPCAMotorController creates a PCAMotorController that will only connect to the pca9685 when Setup is called
+func newUnconnectedPCAMotorController() *PCAMotorController {
 	return &PCAMotorController{
-		pca: pca0,
 		ServoOptions: &pca9685.ServOptions{
 			AcRange:  pca9685.ServoRangeDef,
 			MinPulse: pca9685.ServoMinPulseDef,
@@ -52,3 +71,16 @@ func NewPCAMotorController() *PCAMotorController {
 		},
 	}
 }
+
+// connectPCA9685 connects to the pca9685 on /dev/i2c-1
+func connectPCA9685() (*pca9685.PCA9685, error) {
+	i2c, err := i2c.New(pca9685.Address, "/dev/i2c-1")
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to i2c: %w", err)
+	}
+	pca0, err := pca9685.New(i2c, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to pca9685: %w", err)
+	}
+	return pca0, nil
+}
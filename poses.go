@@ -0,0 +1,107 @@
+package spotpuppy
+
+import "fmt"
+
+const PoseStand = "stand"
+const PoseSit = "sit"
+const PoseLieDown = "lie_down"
+const PoseStretch = "stretch"
+
+// Pose is a named position for all of the legs of a robot, and optionally the body.
+// Leg positions are offsets from the resting position of each leg (see LegIK.GetRestingPosition), so the same pose works on robots with different leg sizes
+type Pose struct {
+	// Legs is the offset of each leg from its resting position. Legs that are not in the map stay at their resting position
+	Legs map[string]Vec3 `json:"legs"`
+	// BodyPose is the pose of the body. If it is nil, the body pose is not changed
+	BodyPose *BodyPose `json:"body_pose,omitempty"`
+}
+
+// DefaultPoses returns the poses that every new robot starts with: stand, sit, lie_down and stretch. Legs that a robot does not have are ignored
+func DefaultPoses() map[string]Pose {
+	return map[string]Pose{
+		PoseStand: {
+			Legs: map[string]Vec3{},
+		},
+		PoseSit: {
+			Legs: map[string]Vec3{
+				LegBackLeft:  Up.Mul(4),
+				LegBackRight: Up.Mul(4),
+			},
+		},
+		PoseLieDown: {
+			Legs: map[string]Vec3{
+				LegFrontLeft:   Up.Mul(4),
+				LegFrontRight:  Up.Mul(4),
+				LegBackLeft:    Up.Mul(4),
+				LegBackRight:   Up.Mul(4),
+				LegMiddleLeft:  Up.Mul(4),
+				LegMiddleRight: Up.Mul(4),
+			},
+		},
+		PoseStretch: {
+			Legs: map[string]Vec3{
+				LegFrontLeft:  Up.Mul(3).Add(Forward.Mul(2)),
+				LegFrontRight: Up.Mul(3).Add(Forward.Mul(2)),
+			},
+		},
+	}
+}
+
+// GetPoseLegPositions returns the position of each leg (relative to its shoulder, like SetLegPosition) in the named pose
+func (q *LeggedRobot) GetPoseLegPositions(name string) (map[string]Vec3, error) {
+	pose, ok := q.Poses[name]
+	if !ok {
+		return nil, fmt.Errorf("the robot has no pose called '%s'", name)
+	}
+	positions := make(map[string]Vec3)
+	for l, ik := range q.Legs {
+		positions[l] = ik.GetRestingPosition().Add(pose.Legs[l])
+	}
+	return positions, nil
+}
+
+// SetPose sets the legs (and body pose, if the pose has one) to the named pose for the next update call. It does not perform any calculations or movement immediately
+func (q *LeggedRobot) SetPose(name string) error {
+	positions, err := q.GetPoseLegPositions(name)
+	if err != nil {
+		return err
+	}
+	for l, pos := range positions {
+		q.SetLegPosition(l, pos)
+	}
+	if bp := q.Poses[name].BodyPose; bp != nil {
+		q.SetBodyPose(*bp)
+	}
+	return nil
+}
+
+// CapturePose saves the current leg positions (and optionally the body pose) as a named pose, replacing any pose with the same name.
+// This is useful for tuning poses by hand, then saving them with SaveToFile
+func (q *LeggedRobot) CapturePose(name string, includeBodyPose bool) {
+	pose := Pose{Legs: make(map[string]Vec3)}
+	for l, ik := range q.Legs {
+		pose.Legs[l] = q.GetLegPosition(l).Sub(ik.GetRestingPosition())
+	}
+	if includeBodyPose {
+		bp := q.GetBodyPose()
+		pose.BodyPose = &bp
+	}
+	if q.Poses == nil {
+		q.Poses = make(map[string]Pose)
+	}
+	q.Poses[name] = pose
+}
+
+// MoveToPose queues a motion that moves the legs (and body pose, if the pose has one) to the named pose over duration seconds
+func (p *MotionPlayer) MoveToPose(name string, duration float64, easing Easing) (*Motion, error) {
+	positions, err := p.robot.GetPoseLegPositions(name)
+	if err != nil {
+		return nil, err
+	}
+	m := NewMotion(positions, duration, easing)
+	if bp := p.robot.Poses[name].BodyPose; bp != nil {
+		pose := *bp
+		m.BodyPose = &pose
+	}
+	return p.Queue(m), nil
+}
@@ -0,0 +1,258 @@
+package spotpuppy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// typeKey is the json key that the name of a registered type is saved under
+const typeKey = "type"
+
+// filterKey is the json key that rotation sensors save their OrientationFilter under
+const filterKey = "filter"
+
+// typeRegistry maps names to functions that create empty objects, and object types back to names
+type typeRegistry struct {
+	kind         string
+	constructors map[string]func() interface{}
+	names        map[reflect.Type]string
+}
+
+func newTypeRegistry(kind string) *typeRegistry {
+	return &typeRegistry{
+		kind:         kind,
+		constructors: make(map[string]func() interface{}),
+		names:        make(map[reflect.Type]string),
+	}
+}
+
+func (r *typeRegistry) register(name string, create func() interface{}) {
+	r.constructors[name] = create
+	r.names[reflect.TypeOf(create())] = name
+}
+
+func (r *typeRegistry) create(name string) (interface{}, error) {
+	create, ok := r.constructors[name]
+	if !ok {
+		return nil, fmt.Errorf("no %s type registered with name '%s'", r.kind, name)
+	}
+	return create(), nil
+}
+
+func (r *typeRegistry) nameOf(v interface{}) (string, bool) {
+	name, ok := r.names[reflect.TypeOf(v)]
+	return name, ok
+}
+
+var legIKTypes = newTypeRegistry("LegIK")
+var motorControllerTypes = newTypeRegistry("MotorController")
+var rotationSensorTypes = newTypeRegistry("RotationSensor")
+var orientationFilterTypes = newTypeRegistry("OrientationFilter")
+
+// RegisterLegIK registers a LegIK type under a name, so that it can be rebuilt when loading from a file.
+// newIK should create an empty LegIK, in the same way as the generator passed to NewQuadruped
+func RegisterLegIK(name string, newIK func() LegIK) {
+	legIKTypes.register(name, func() interface{} { return newIK() })
+}
+
+// RegisterMotorController registers a MotorController type under a name, so that it can be rebuilt when loading from a file.
+// newController should create an empty MotorController, and is called once when registering, so it should not connect to any hardware (that should be done in Setup)
+func RegisterMotorController(name string, newController func() MotorController) {
+	motorControllerTypes.register(name, func() interface{} { return newController() })
+}
+
+// RegisterRotationSensor registers a RotationSensor type under a name, so that it can be rebuilt when loading from a file.
+// newSensor should create an empty RotationSensor, and is called once when registering, so it should not connect to any hardware (that should be done in Setup)
+func RegisterRotationSensor(name string, newSensor func() RotationSensor) {
+	rotationSensorTypes.register(name, func() interface{} { return newSensor() })
+}
+
+// RegisterOrientationFilter registers an OrientationFilter type under a name, so that it can be rebuilt when loading a rotation sensor from a file
+func RegisterOrientationFilter(name string, newFilter func() OrientationFilter) {
+	orientationFilterTypes.register(name, func() interface{} { return newFilter() })
+}
+
+// newRegisteredLegIK creates an empty LegIK of the type registered under name
+func newRegisteredLegIK(name string) (LegIK, error) {
+	ik, err := legIKTypes.create(name)
+	if err != nil {
+		return nil, err
+	}
+	return ik.(LegIK), nil
+}
+
+// newRegisteredMotorController creates an empty MotorController of the type registered under name
+func newRegisteredMotorController(name string) (MotorController, error) {
+	mc, err := motorControllerTypes.create(name)
+	if err != nil {
+		return nil, err
+	}
+	return mc.(MotorController), nil
+}
+
+// newRegisteredRotationSensor creates an empty RotationSensor of the type registered under name
+func newRegisteredRotationSensor(name string) (RotationSensor, error) {
+	rs, err := rotationSensorTypes.create(name)
+	if err != nil {
+		return nil, err
+	}
+	return rs.(RotationSensor), nil
+}
+
+// newRegisteredOrientationFilter creates an empty OrientationFilter of the type registered under name
+func newRegisteredOrientationFilter(name string) (OrientationFilter, error) {
+	f, err := orientationFilterTypes.create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.(OrientationFilter), nil
+}
+
+// unmarshalOrientationFilter loads a filter from json. If the filter was saved with a registered type name, and filter is not already that type,
+// a new filter of that type is created. If there is no filter to load into, nil is returned
+func unmarshalOrientationFilter(data json.RawMessage, filter OrientationFilter) (OrientationFilter, error) {
+	if len(data) == 0 {
+		return filter, nil
+	}
+	name, err := readTypeName(data)
+	if err != nil {
+		return nil, err
+	}
+	if existingName, _ := orientationFilterTypes.nameOf(filter); name != "" && name != existingName {
+		filter, err = newRegisteredOrientationFilter(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if filter == nil {
+		return nil, nil
+	}
+	err = json.Unmarshal(data, filter)
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// marshalWithFilter marshals fields, which should have the same fields as a rotation sensor but none of its methods, with its filter saved along with the filter's registered type name
+func marshalWithFilter(fields interface{}, filter OrientationFilter) ([]byte, error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	object := make(map[string]json.RawMessage)
+	err = json.Unmarshal(data, &object)
+	if err != nil {
+		return nil, err
+	}
+	object[filterKey], err = marshalRegistered(orientationFilterTypes, filter)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(object)
+}
+
+// unmarshalWithFilter is the inverse of marshalWithFilter. It loads everything except the filter into fields, then loads the filter with unmarshalOrientationFilter
+func unmarshalWithFilter(data []byte, fields interface{}, filter *OrientationFilter) error {
+	object := make(map[string]json.RawMessage)
+	err := json.Unmarshal(data, &object)
+	if err != nil {
+		return err
+	}
+	// The filter is an interface, so json cannot load it by itself
+	filterData := object[filterKey]
+	delete(object, filterKey)
+	data, err = json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, fields)
+	if err != nil {
+		return err
+	}
+	*filter, err = unmarshalOrientationFilter(filterData, *filter)
+	return err
+}
+
+// marshalRegistered marshals v to json, adding its type name if its type is in the registry
+func marshalRegistered(r *typeRegistry, v interface{}) ([]byte, error) {
+	if name, ok := r.nameOf(v); ok {
+		return marshalWithType(v, name)
+	}
+	return json.Marshal(v)
+}
+
+// marshalWithType marshals v to a json object, and adds the type name to it
+func marshalWithType(v interface{}, name string) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+	fields[typeKey], err = json.Marshal(name)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// readTypeName reads the type name from a json object. If the object has no type name, it returns an empty string
+func readTypeName(data []byte) (string, error) {
+	fields := make(map[string]json.RawMessage)
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return "", err
+	}
+	raw, ok := fields[typeKey]
+	if !ok {
+		return "", nil
+	}
+	name := ""
+	err = json.Unmarshal(raw, &name)
+	return name, err
+}
+
+// SaveRotationSensorToFile saves a rotation sensor to a file, along with its registered type name
+func SaveRotationSensorToFile(sensor RotationSensor, filename string) error {
+	data, err := marshalRegistered(rotationSensorTypes, sensor)
+	if err != nil {
+		return err
+	}
+	s, err := json.MarshalIndent(json.RawMessage(data), "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, s, 0644)
+}
+
+// LoadRotationSensorFromFile creates a rotation sensor from a file saved with SaveRotationSensorToFile, then calls Setup on it.
+// The type of the sensor must have been registered with RegisterRotationSensor
+func LoadRotationSensorFromFile(filename string) (RotationSensor, error) {
+	s, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	name, err := readTypeName(s)
+	if err != nil {
+		return nil, err
+	}
+	sensor, err := newRegisteredRotationSensor(name)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(s, sensor)
+	if err != nil {
+		return nil, err
+	}
+	err = sensor.Setup()
+	if err != nil {
+		return nil, err
+	}
+	return sensor, nil
+}
@@ -2,43 +2,139 @@ package spotpuppy
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"sort"
 )
 
 const LegFrontLeft = "front_left"
 const LegFrontRight = "front_right"
 const LegBackLeft = "back_left"
 const LegBackRight = "back_right"
+const LegMiddleLeft = "middle_left"
+const LegMiddleRight = "middle_right"
 
 type legs map[string]LegIK
 
-// AllLegs is an ordered list of all the legs of a robot, useful for looping
+// AllLegs is an ordered list of all the legs of a quadruped, useful for looping
 var AllLegs = []string{LegFrontLeft, LegFrontRight, LegBackLeft, LegBackRight}
 
-// Quadruped is a type to collect four LegIK objects, a motor controller, and some robot info together, to allow easy control
-type Quadruped struct {
-	Legs               legs            `json:"legs"`
-	MotorController    MotorController `json:"motor_controller"`
-	BodyDimensionX     float64         `json:"body_dimension_x"`
-	BodyDimensionZ     float64         `json:"body_dimension_z"`
-	cachedLegPositions map[string]Vec3
-	cachedLegRotations map[string][]float64
+// AllHexapodLegs is an ordered list of all the legs of a hexapod, useful for looping
+var AllHexapodLegs = []string{LegFrontLeft, LegFrontRight, LegMiddleLeft, LegMiddleRight, LegBackLeft, LegBackRight}
+
+// LeggedRobot is a type to collect any number of named LegIK objects, a motor controller, and some robot info together, to allow easy control.
+// Motors are named "leg.joint", where leg is the name of the leg and joint is the name of the motor from the LegIK
+type LeggedRobot struct {
+	Legs            legs            `json:"legs"`
+	MotorController MotorController `json:"motor_controller"`
+	BodyDimensionX  float64         `json:"body_dimension_x"`
+	BodyDimensionZ  float64         `json:"body_dimension_z"`
+	// LegMounts is where each leg is attached to the body. Legs that are not in the map are attached at the corners of the body (see GetLegMount)
+	LegMounts map[string]LegMount `json:"leg_mounts"`
+	// Poses are the named poses of the robot (see SetPose). New quadrupeds start with DefaultPoses
+	Poses               map[string]Pose `json:"poses"`
+	cachedLegPositions  map[string]Vec3
+	cachedFootPositions map[string]Vec3
+	cachedLegResults    map[string]IKResult
+	bodyPose            BodyPose
 }
 
-// ShoulderVec gets the Vec3 between the robots center and the shoulder joint of the leg specified
-func (q *Quadruped) ShoulderVec(leg string) Vec3 {
+// Quadruped is a LeggedRobot with four legs (see AllLegs). Everything that works on a Quadruped also works on a LeggedRobot with any number of legs
+type Quadruped = LeggedRobot
+
+// LegMount is where a leg is attached to the body of a robot
+type LegMount struct {
+	// Position is the position of the shoulder joint relative to the center of the body
+	Position Vec3 `json:"position"`
+	// Rotation is the rotation of the leg relative to the body. Leg positions (like SetLegPosition) are in the rotated space of the leg,
+	// so a leg mounted with a rotation can use the same LegIK as a leg mounted straight down
+	Rotation Quat `json:"rotation"`
+}
+
+// NewLegMount creates a new LegMount from a position and a rotation
+func NewLegMount(position Vec3, rotation Quat) LegMount {
+	return LegMount{
+		Position: position,
+		Rotation: rotation,
+	}
+}
+
+// GetLegMount returns where a leg is attached to the body. Legs that are not in LegMounts are attached straight down at a corner of the body
+// (or half way along each side for the middle legs), using BodyDimensionX and BodyDimensionZ
+func (q *LeggedRobot) GetLegMount(leg string) LegMount {
+	if m, ok := q.LegMounts[leg]; ok {
+		// A mount loaded from a file without a rotation is not rotated
+		if m.Rotation == (Quat{}) {
+			m.Rotation = QuatIdentity
+		}
+		return m
+	}
 	switch leg {
 	case LegFrontLeft:
-		return NewVector3(q.BodyDimensionX/2, 0, q.BodyDimensionZ/2)
+		return NewLegMount(NewVector3(q.BodyDimensionX/2, 0, q.BodyDimensionZ/2), QuatIdentity)
 	case LegFrontRight:
-		return NewVector3(q.BodyDimensionX/2, 0, -q.BodyDimensionZ/2)
+		return NewLegMount(NewVector3(q.BodyDimensionX/2, 0, -q.BodyDimensionZ/2), QuatIdentity)
 	case LegBackLeft:
-		return NewVector3(-q.BodyDimensionX/2, 0, q.BodyDimensionZ/2)
+		return NewLegMount(NewVector3(-q.BodyDimensionX/2, 0, q.BodyDimensionZ/2), QuatIdentity)
 	case LegBackRight:
-		return NewVector3(-q.BodyDimensionX/2, 0, -q.BodyDimensionZ/2)
+		return NewLegMount(NewVector3(-q.BodyDimensionX/2, 0, -q.BodyDimensionZ/2), QuatIdentity)
+	case LegMiddleLeft:
+		return NewLegMount(NewVector3(0, 0, q.BodyDimensionZ/2), QuatIdentity)
+	case LegMiddleRight:
+		return NewLegMount(NewVector3(0, 0, -q.BodyDimensionZ/2), QuatIdentity)
 	default:
-		return NewVector3(0, 0, 0)
+		return NewLegMount(NewVector3(0, 0, 0), QuatIdentity)
+	}
+}
+
+// ShoulderVec gets the Vec3 between the robots center and the shoulder joint of the leg specified
+func (q *LeggedRobot) ShoulderVec(leg string) Vec3 {
+	return q.GetLegMount(leg).Position
+}
+
+// LegToBody converts a position relative to the shoulder of a leg (like SetLegPosition) to a position relative to the center of the body
+func (q *LeggedRobot) LegToBody(leg string, pos Vec3) Vec3 {
+	m := q.GetLegMount(leg)
+	return pos.Rotated(m.Rotation).Add(m.Position)
+}
+
+// BodyToLeg converts a position relative to the center of the body to a position relative to the shoulder of a leg (like SetLegPosition)
+func (q *LeggedRobot) BodyToLeg(leg string, pos Vec3) Vec3 {
+	m := q.GetLegMount(leg)
+	return pos.Sub(m.Position).Rotated(m.Rotation.Inv())
+}
+
+// LegNames returns the names of all of the legs of the robot. The standard legs (in the same order as AllHexapodLegs) come first, followed by any other legs in alphabetical order
+func (q *LeggedRobot) LegNames() []string {
+	return sortedLegNames(q.Legs)
+}
+
+// sortedLegNames returns the names of the legs in a map, with the standard legs (in the same order as AllHexapodLegs) first, followed by any other legs in alphabetical order
+func sortedLegNames(iks map[string]LegIK) []string {
+	names := make([]string, 0, len(iks))
+	for _, l := range AllHexapodLegs {
+		if _, ok := iks[l]; ok {
+			names = append(names, l)
+		}
+	}
+	others := make([]string, 0)
+	for l := range iks {
+		if !isStandardLeg(l) {
+			others = append(others, l)
+		}
 	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// isStandardLeg returns true if the leg is one of AllHexapodLegs (which includes all of AllLegs)
+func isStandardLeg(leg string) bool {
+	for _, l := range AllHexapodLegs {
+		if l == leg {
+			return true
+		}
+	}
+	return false
 }
 
 // NewQuadruped creates a new quadruped from a function to create empty LegIK objects, and a MotorController.
@@ -51,33 +147,78 @@ func NewQuadruped(newIK func() LegIK, motorController MotorController) *Quadrupe
 // No objects in the robot will be set up correctly, and it is recommended that a file load is performed before anything else
 func NewQuadrupedWithExtraMotors(newIK func() LegIK, motorController MotorController, extraMotors []string) *Quadruped {
 	iks := make(map[string]LegIK)
-	cachedLegPositions := make(map[string]Vec3, 4)
 	for _, l := range AllLegs {
 		iks[l] = newIK()
-		cachedLegPositions[l] = iks[l].GetRestingPosition()
+	}
+	return NewQuadrupedWithLegIKs(iks, motorController, extraMotors)
+}
+
+// NewQuadrupedWithLegIKs creates a new quadruped from a map of leg name to LegIK, and a MotorController. This allows each leg to have a different LegIK type.
+// It also adds the specified servo names to the servo map.
+// No objects in the robot will be set up correctly, and it is recommended that a file load is performed before anything else
+func NewQuadrupedWithLegIKs(iks map[string]LegIK, motorController MotorController, extraMotors []string) *Quadruped {
+	return NewQuadrupedWithLayout(iks, map[string]LegMount{}, motorController, extraMotors)
+}
+
+// NewQuadrupedWithLayout creates a new quadruped from a map of leg name to LegIK, a map of leg name to LegMount, and a MotorController.
+// This allows legs to have any name, and to be attached anywhere on the body. Legs without a LegMount are attached at the corners of the body (see GetLegMount).
+// It also adds the specified servo names to the servo map.
+// No objects in the robot will be set up correctly, and it is recommended that a file load is performed before anything else
+func NewQuadrupedWithLayout(iks map[string]LegIK, mounts map[string]LegMount, motorController MotorController, extraMotors []string) *Quadruped {
+	return NewLeggedRobot(iks, mounts, motorController, extraMotors)
+}
+
+// NewHexapod creates a new hexapod (a LeggedRobot with the six legs in AllHexapodLegs) from a function to create empty LegIK objects, and a MotorController.
+// The middle legs are attached half way along each side of the body.
+// No objects in the robot will be set up correctly, and it is recommended that a file load is performed before anything else
+func NewHexapod(newIK func() LegIK, motorController MotorController) *LeggedRobot {
+	return NewHexapodWithExtraMotors(newIK, motorController, []string{})
+}
+
+// NewHexapodWithExtraMotors creates a new hexapod from a function to create empty LegIK objects, and a MotorController. It also adds the specified servo names to the servo map.
+// No objects in the robot will be set up correctly, and it is recommended that a file load is performed before anything else
+func NewHexapodWithExtraMotors(newIK func() LegIK, motorController MotorController, extraMotors []string) *LeggedRobot {
+	iks := make(map[string]LegIK)
+	for _, l := range AllHexapodLegs {
+		iks[l] = newIK()
+	}
+	return NewLeggedRobot(iks, map[string]LegMount{}, motorController, extraMotors)
+}
+
+// NewLeggedRobot creates a new robot with any number of legs, from a map of leg name to LegIK, a map of leg name to LegMount, and a MotorController.
+// Legs without a LegMount use the standard mounts (see GetLegMount). It also adds the specified servo names to the servo map.
+// No objects in the robot will be set up correctly, and it is recommended that a file load is performed before anything else
+func NewLeggedRobot(iks map[string]LegIK, mounts map[string]LegMount, motorController MotorController, extraMotors []string) *LeggedRobot {
+	cachedLegPositions := make(map[string]Vec3, len(iks))
+	for l, ik := range iks {
+		cachedLegPositions[l] = ik.GetRestingPosition()
 	}
 	names := make([]string, 0)
-	for _, l := range AllLegs {
+	for _, l := range sortedLegNames(iks) {
 		for _, j := range iks[l].GetMotorNames() {
 			names = append(names, l+"."+j)
 		}
 	}
 	motorController.CreateMotorMapping(append(names, extraMotors...))
-	return &Quadruped{
-		Legs:               iks,
-		MotorController:    motorController,
-		cachedLegPositions: cachedLegPositions,
-		cachedLegRotations: make(map[string][]float64),
+	return &LeggedRobot{
+		Legs:                iks,
+		MotorController:     motorController,
+		LegMounts:           mounts,
+		cachedLegPositions:  cachedLegPositions,
+		cachedFootPositions: make(map[string]Vec3),
+		cachedLegResults:    make(map[string]IKResult),
+		Poses:               DefaultPoses(),
+		bodyPose:            NewBodyPose(Zero, QuatIdentity),
 	}
 }
 
 // SetExtraMotorNow sets the named motor to a position, without waiting for the next update loop
-func (q *Quadruped) SetExtraMotorNow(motorName string, angle float64) {
+func (q *LeggedRobot) SetExtraMotorNow(motorName string, angle float64) {
 	q.MotorController.SetMotor(motorName, angle)
 }
 
-// SaveToFile saves this quadruped to a file
-func (q *Quadruped) SaveToFile(filename string) error {
+// SaveToFile saves this robot to a file
+func (q *LeggedRobot) SaveToFile(filename string) error {
 	s, err := json.MarshalIndent(q, "", "\t")
 	if err != nil {
 		return err
@@ -89,28 +230,138 @@ func (q *Quadruped) SaveToFile(filename string) error {
 	return nil
 }
 
-// LoadFromFile loads some quadruped data from a file. It is important to make sure the quadruped that created that file had the same LegIK and MotorController types
-func (q *Quadruped) LoadFromFile(filename string) error {
+// LoadFromFile loads some robot data from a file.
+// Legs and motor controllers that were saved with a registered type (see RegisterLegIK and RegisterMotorController) are rebuilt with that type,
+// anything else must already have the same type as the robot that created the file
+func (q *LeggedRobot) LoadFromFile(filename string) error {
 	s, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
+	oldLegs := make(map[string]LegIK)
+	for k, v := range q.Legs {
+		oldLegs[k] = v
+	}
 	err = json.Unmarshal(s, q)
 	if err != nil {
 		return err
 	}
-	q.MotorController.Setup()
-	return nil
+	// Any legs that have been replaced with a new LegIK type should start at their new resting position
+	for k, v := range q.Legs {
+		if oldLegs[k] != v {
+			q.cachedLegPositions[k] = v.GetRestingPosition()
+		}
+	}
+	if q.MotorController == nil {
+		return fmt.Errorf("robot has no motor controller to load into, and the file does not have a motor controller type")
+	}
+	return q.MotorController.Setup()
+}
+
+// LoadQuadrupedFromFile creates a new quadruped purely from a file. All of the LegIK and MotorController types in the file must be registered
+func LoadQuadrupedFromFile(filename string) (*Quadruped, error) {
+	return LoadLeggedRobotFromFile(filename)
+}
+
+// LoadLeggedRobotFromFile creates a new robot purely from a file, with whichever legs are in the file. All of the LegIK and MotorController types in the file must be registered
+func LoadLeggedRobotFromFile(filename string) (*LeggedRobot, error) {
+	q := &LeggedRobot{
+		cachedLegPositions:  make(map[string]Vec3),
+		cachedFootPositions: make(map[string]Vec3),
+		cachedLegResults:    make(map[string]IKResult),
+		Poses:               DefaultPoses(),
+		bodyPose:            NewBodyPose(Zero, QuatIdentity),
+	}
+	err := q.LoadFromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// leggedRobotJSON has the same fields as LeggedRobot, but none of its methods, so it can be used inside LeggedRobot's json methods
+type leggedRobotJSON LeggedRobot
+
+// MarshalJSON saves the robot, including the registered type name of the motor controller
+func (q *LeggedRobot) MarshalJSON() ([]byte, error) {
+	mc, err := marshalRegistered(motorControllerTypes, q.MotorController)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		*leggedRobotJSON
+		MotorController json.RawMessage `json:"motor_controller"`
+	}{(*leggedRobotJSON)(q), mc})
+}
+
+// UnmarshalJSON loads the robot. If the motor controller was saved with a registered type name, and the existing motor controller is not already that type,
+// a new motor controller of that type is created
+func (q *LeggedRobot) UnmarshalJSON(data []byte) error {
+	fields := struct {
+		*leggedRobotJSON
+		MotorController json.RawMessage `json:"motor_controller"`
+	}{leggedRobotJSON: (*leggedRobotJSON)(q)}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	if len(fields.MotorController) == 0 {
+		return nil
+	}
+	name, err := readTypeName(fields.MotorController)
+	if err != nil {
+		return err
+	}
+	if existingName, _ := motorControllerTypes.nameOf(q.MotorController); name != "" && name != existingName {
+		q.MotorController, err = newRegisteredMotorController(name)
+		if err != nil {
+			return err
+		}
+	}
+	if q.MotorController == nil {
+		return nil
+	}
+	return json.Unmarshal(fields.MotorController, q.MotorController)
 }
 
-// UnmarshalJSON allows unmarshalling into the interface type LegIK
+// MarshalJSON saves each LegIK along with its registered type name, so that the correct type can be rebuilt when loading
+func (l legs) MarshalJSON() ([]byte, error) {
+	legs := make(map[string]json.RawMessage)
+	for k, v := range l {
+		data, err := marshalRegistered(legIKTypes, v)
+		if err != nil {
+			return nil, err
+		}
+		legs[k] = data
+	}
+	return json.Marshal(legs)
+}
+
+// UnmarshalJSON allows unmarshalling into the interface type LegIK.
+// If a leg was saved with a registered type name, and the existing LegIK is not already that type, a new LegIK of that type is created
 func (l *legs) UnmarshalJSON(data []byte) error {
 	legs := make(map[string]json.RawMessage)
 	err := json.Unmarshal(data, &legs)
 	if err != nil {
 		return err
 	}
+	if *l == nil {
+		*l = make(map[string]LegIK)
+	}
 	for k, v := range legs {
+		name, err := readTypeName(v)
+		if err != nil {
+			return err
+		}
+		if existingName, _ := legIKTypes.nameOf((*l)[k]); name != "" && name != existingName {
+			(*l)[k], err = newRegisteredLegIK(name)
+			if err != nil {
+				return err
+			}
+		}
+		if (*l)[k] == nil {
+			return fmt.Errorf("leg '%s' has no LegIK to load into, and was not saved with a type", k)
+		}
 		err = (*l)[k].LoadJson(v)
 		if err != nil {
 			return err
@@ -120,20 +371,43 @@ func (l *legs) UnmarshalJSON(data []byte) error {
 }
 
 // SetLegPosition sets a legs position for the next update call. It does not perform any calculations or movement immediately.
-func (q *Quadruped) SetLegPosition(leg string, pos Vec3) {
+// The position is relative to the shoulder of the leg, and is not affected by the body pose
+func (q *LeggedRobot) SetLegPosition(leg string, pos Vec3) {
 	q.cachedLegPositions[leg] = pos
+	delete(q.cachedFootPositions, leg)
 }
 
-// Update takes the most recent leg positions (set with SetLegPosition), calculates the motor angles with LegIK, and sets the motors with the MotorController
-func (q *Quadruped) Update() {
-	for _, l := range AllLegs {
-		q.cachedLegRotations[l] = q.Legs[l].CalculateMotorRotations(q.cachedLegPositions[l])
+// GetLegPosition returns the position that the leg will be moved to on the next update call, relative to the shoulder of the leg.
+// If the leg was set with SetFootPosition, this uses the current body pose
+func (q *LeggedRobot) GetLegPosition(leg string) Vec3 {
+	if foot, ok := q.cachedFootPositions[leg]; ok {
+		return q.footToLeg(leg, foot)
 	}
-	for _, l := range AllLegs {
-		r := q.cachedLegRotations[l]
+	return q.cachedLegPositions[leg]
+}
+
+// Update takes the most recent leg positions (set with SetLegPosition or SetFootPosition), calculates the motor angles with LegIK, and sets the motors with the MotorController.
+// Motors are never set past their limits (see LimitedLegIK), even if the LegIK returned a rotation outside of them
+func (q *LeggedRobot) Update() {
+	for l, foot := range q.cachedFootPositions {
+		q.cachedLegPositions[l] = q.footToLeg(l, foot)
+	}
+	legNames := q.LegNames()
+	for _, l := range legNames {
+		q.cachedLegResults[l] = SolveLegIK(q.Legs[l], q.cachedLegPositions[l])
+	}
+	for _, l := range legNames {
+		r := q.cachedLegResults[l].Rotations
 		names := q.Legs[l].GetMotorNames()
+		limits := getMotorLimits(q.Legs[l])
 		for i := range r {
-			q.MotorController.SetMotor(l+"."+names[i], r[i])
+			q.MotorController.SetMotor(l+"."+names[i], limits[i].Clamp(r[i]))
 		}
 	}
 }
+
+// GetLegIKResult returns the IKResult for a leg from the most recent Update call.
+// This can be used to find out if the leg reached the position set with SetLegPosition, and where the foot actually is
+func (q *LeggedRobot) GetLegIKResult(leg string) IKResult {
+	return q.cachedLegResults[leg]
+}
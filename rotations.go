@@ -135,7 +135,8 @@ func (q Quat) NoYaw() Quat {
 	return q.RotateByGlobal(correction)
 }
 
-// Returns the heading angle of this quaternion in degrees. This suffers from gimbal lock
+// Returns the heading angle of this quaternion in degrees, anticlockwise (when looking down) from Forward. This suffers from gimbal lock.
+// For a rotation sensor with a magnetometer (see MagneticHeading), Forward is north, so this is an absolute heading
 func (q Quat) HeadingAngle() float64 {
 	fwdDir := Forward.Rotated(q).ProjectToPlane(Up)
 	// Ensure that the forward direction is not pointing straight up
@@ -146,6 +147,35 @@ func (q Quat) HeadingAngle() float64 {
 	return Degrees(math.Atan2(fwdDir.Z, fwdDir.X))
 }
 
+// CompassHeading returns the heading angle of this quaternion like a compass, in degrees from 0 to 360, clockwise (when looking down) from Forward.
+// For a rotation sensor with a magnetometer (see MagneticHeading), this is the heading from north
+func (q Quat) CompassHeading() float64 {
+	h := math.Mod(360-q.HeadingAngle(), 360)
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+// Slerp returns the rotation part of the way (t, from 0 to 1) from q to q2, using spherical linear interpolation
+func (q Quat) Slerp(q2 Quat, t float64) Quat {
+	q, q2 = q.Unit(), q2.Unit()
+	dot := q.W*q2.W + q.X*q2.X + q.Y*q2.Y + q.Z*q2.Z
+	// Go the short way round
+	if dot < 0 {
+		q2 = q2.Neg()
+		dot = -dot
+	}
+	// If the rotations are very close, linear interpolation is accurate enough and avoids dividing by zero
+	if dot > 0.9995 {
+		return NewQuat(q.W+(q2.W-q.W)*t, q.X+(q2.X-q.X)*t, q.Y+(q2.Y-q.Y)*t, q.Z+(q2.Z-q.Z)*t).Unit()
+	}
+	angle := math.Acos(dot)
+	a := math.Sin((1-t)*angle) / math.Sin(angle)
+	b := math.Sin(t*angle) / math.Sin(angle)
+	return NewQuat(a*q.W+b*q2.W, a*q.X+b*q2.X, a*q.Y+b*q2.Y, a*q.Z+b*q2.Z)
+}
+
 // String converts this quaternion to a string
 func (q Quat) String() string {
 	return fmt.Sprintf("(w%.2f,x%.2f,y%.2f,z%.2f)", q.W, q.X, q.Y, q.Z)
@@ -186,6 +216,17 @@ func (a *AxesRemapper) RemapInverse(v Vec3) Vec3 {
 	return a.SrcForwardVector.Mul(fwd).Add(a.SrcLeftVector.Mul(lft)).Add(a.SrcUpVector.Mul(up))
 }
 
+// RemapQuat remaps a rotation from coordinate system with Src axes to coordinate system with Target axes, so that it turns remapped vectors in the same way
+func (a *AxesRemapper) RemapQuat(q Quat) Quat {
+	axis := a.Remap(NewVector3(q.X, q.Y, q.Z))
+	// If the remapping mirrors the axes, rotations are reversed too
+	x, y, z := a.Remap(NewVector3(1, 0, 0)), a.Remap(NewVector3(0, 1, 0)), a.Remap(NewVector3(0, 0, 1))
+	if x.Dot(y.Cross(z)) < 0 {
+		axis = axis.Inv()
+	}
+	return NewQuat(q.W, axis.X, axis.Y, axis.Z)
+}
+
 /*
 // Euler returns the Euler angles phi, theta, psi corresponding to a Quaternion
 func (q Quat) Euler() (float64, float64, float64) {
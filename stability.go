@@ -0,0 +1,101 @@
+package spotpuppy
+
+import (
+	"math"
+	"sort"
+)
+
+// SupportPolygon returns the convex hull of some foot positions, projected onto the ground (the plane with Up as its normal).
+// The points of the polygon are in anticlockwise order when looking down, and have a Y of 0
+func SupportPolygon(feet []Vec3) []Vec3 {
+	points := make([]Vec3, len(feet))
+	for i, f := range feet {
+		points[i] = NewVector3(f.X, 0, f.Z)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].X != points[j].X {
+			return points[i].X < points[j].X
+		}
+		return points[i].Z < points[j].Z
+	})
+	if len(points) < 3 {
+		return points
+	}
+	// Andrew's monotone chain
+	hull := make([]Vec3, 0, 2*len(points))
+	for _, p := range points {
+		for len(hull) >= 2 && crossXZ(hull[len(hull)-1].Sub(hull[len(hull)-2]), p.Sub(hull[len(hull)-2])) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	lower := len(hull) + 1
+	for i := len(points) - 2; i >= 0; i-- {
+		p := points[i]
+		for len(hull) >= lower && crossXZ(hull[len(hull)-1].Sub(hull[len(hull)-2]), p.Sub(hull[len(hull)-2])) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	return hull[:len(hull)-1]
+}
+
+// StabilityMargin returns the distance from the center of mass (projected onto the ground) to the nearest edge of a support polygon (from SupportPolygon).
+// It is positive if the center of mass is inside the polygon, so the robot is statically stable, and negative if it is outside.
+// A polygon with fewer than 3 points has no area, so the margin is never positive
+func StabilityMargin(com Vec3, polygon []Vec3) float64 {
+	p := NewVector3(com.X, 0, com.Z)
+	if len(polygon) == 0 {
+		return math.Inf(-1)
+	}
+	outside := math.Inf(1)
+	for i := range polygon {
+		outside = math.Min(outside, distanceToSegment(p, polygon[i], polygon[(i+1)%len(polygon)]))
+	}
+	if len(polygon) < 3 {
+		return -outside
+	}
+	inside := math.Inf(1)
+	for i := range polygon {
+		a, b := polygon[i], polygon[(i+1)%len(polygon)]
+		edge := b.Sub(a)
+		d := crossXZ(edge, p.Sub(a)) / edge.Len()
+		if d < 0 {
+			return -outside
+		}
+		inside = math.Min(inside, d)
+	}
+	return inside
+}
+
+// GetSupportPolygon returns the support polygon of the feet of the stance legs (the legs with their feet on the ground), using the foot positions from GetFootPosition
+func (q *LeggedRobot) GetSupportPolygon(stanceLegs []string) []Vec3 {
+	feet := make([]Vec3, len(stanceLegs))
+	for i, l := range stanceLegs {
+		feet[i] = q.GetFootPosition(l)
+	}
+	return SupportPolygon(feet)
+}
+
+// GetStabilityMargin returns the stability margin (see StabilityMargin) of the quadruped when only the stance legs have their feet on the ground.
+// com is the center of mass relative to the center of the body, and is moved with the current body pose
+func (q *LeggedRobot) GetStabilityMargin(com Vec3, stanceLegs []string) float64 {
+	worldCom := com.Rotated(q.bodyPose.Rotation).Add(q.bodyPose.Position)
+	return StabilityMargin(worldCom, q.GetSupportPolygon(stanceLegs))
+}
+
+// crossXZ returns the Up component of the cross product of two vectors on the ground. It is positive if b is anticlockwise from a when looking down
+func crossXZ(a, b Vec3) float64 {
+	return a.X*b.Z - a.Z*b.X
+}
+
+// distanceToSegment returns the distance from p to the closest point on the line segment from a to b
+func distanceToSegment(p, a, b Vec3) float64 {
+	ab := b.Sub(a)
+	l2 := ab.Dot(ab)
+	if l2 == 0 {
+		return p.Sub(a).Len()
+	}
+	t := clamp(p.Sub(a).Dot(ab)/l2, 0, 1)
+	return p.Sub(a.Add(ab.Mul(t))).Len()
+}
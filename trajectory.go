@@ -0,0 +1,142 @@
+package spotpuppy
+
+import "math"
+
+// Trajectory is a path for a foot to follow. Position is evaluated by phase, where 0 is the start of the path and 1 is the end
+type Trajectory interface {
+	Position(phase float64) Vec3
+}
+
+// SwingGenerator creates a swing trajectory, which lifts a foot off the ground at liftOff, and puts it back down at touchDown.
+// The foot is lifted by roughly height at the highest point of the swing
+type SwingGenerator func(liftOff, touchDown Vec3, height float64) Trajectory
+
+// StanceGenerator creates a stance trajectory, which moves a foot along the ground from touchDown to liftOff.
+// The foot is pushed into the ground by roughly depth half way through the stance
+type StanceGenerator func(touchDown, liftOff Vec3, depth float64) Trajectory
+
+// BezierTrajectory is a bezier curve through any number of control points
+type BezierTrajectory struct {
+	Points []Vec3
+}
+
+// NewBezierTrajectory creates a bezier curve from its control points
+func NewBezierTrajectory(points ...Vec3) *BezierTrajectory {
+	return &BezierTrajectory{Points: points}
+}
+
+// Position evaluates the bezier curve at phase
+func (b *BezierTrajectory) Position(phase float64) Vec3 {
+	if len(b.Points) == 0 {
+		return Zero
+	}
+	// De Casteljau's algorithm
+	points := make([]Vec3, len(b.Points))
+	copy(points, b.Points)
+	for n := len(points) - 1; n > 0; n-- {
+		for i := 0; i < n; i++ {
+			points[i] = points[i].Add(points[i+1].Sub(points[i]).Mul(phase))
+		}
+	}
+	return points[0]
+}
+
+// bezierSwingStride and bezierSwingHeight are the 12 control points for a bezier swing, as used on the MIT Cheetah.
+// Stride is in halves of the step length, from -1 (lift off) to 1 (touch down), and height is a multiple of the step height
+var bezierSwingStride = []float64{-1, -1.4, -1.5, -1.5, -1.5, 0, 0, 0, 1.5, 1.5, 1.4, 1}
+var bezierSwingHeight = []float64{0, 0, 0.9, 0.9, 0.9, 0.9, 0.9, 1.1, 1.1, 1.1, 0, 0}
+
+// NewBezierSwing creates a 12 point bezier swing trajectory (like the MIT Cheetah).
+// The foot pulls back slightly after lifting off and overshoots slightly before touching down, which gives a fast, clean lift and a soft landing
+func NewBezierSwing(liftOff, touchDown Vec3, height float64) Trajectory {
+	points := make([]Vec3, len(bezierSwingStride))
+	for i := range points {
+		stride := (bezierSwingStride[i] + 1) / 2
+		points[i] = liftOff.Add(touchDown.Sub(liftOff).Mul(stride)).Add(Up.Mul(height * bezierSwingHeight[i]))
+	}
+	return NewBezierTrajectory(points...)
+}
+
+// CycloidTrajectory moves a foot along a cycloid, which has zero velocity at lift off and touch down
+type CycloidTrajectory struct {
+	LiftOff   Vec3
+	TouchDown Vec3
+	Height    float64
+}
+
+// NewCycloidSwing creates a cycloid swing trajectory
+func NewCycloidSwing(liftOff, touchDown Vec3, height float64) Trajectory {
+	return &CycloidTrajectory{
+		LiftOff:   liftOff,
+		TouchDown: touchDown,
+		Height:    height,
+	}
+}
+
+// Position evaluates the cycloid at phase
+func (c *CycloidTrajectory) Position(phase float64) Vec3 {
+	angle := 2 * math.Pi * phase
+	stride := (angle - math.Sin(angle)) / (2 * math.Pi)
+	lift := c.Height * (1 - math.Cos(angle)) / 2
+	return c.LiftOff.Add(c.TouchDown.Sub(c.LiftOff).Mul(stride)).Add(Up.Mul(lift))
+}
+
+// PolynomialTrajectory moves a foot along quintic polynomials. The foot moves along the step with a minimum jerk profile,
+// and rises then falls with a quintic profile, so velocity and acceleration are zero at lift off, the highest point, and touch down
+type PolynomialTrajectory struct {
+	LiftOff   Vec3
+	TouchDown Vec3
+	Height    float64
+}
+
+// NewPolynomialSwing creates a quintic polynomial swing trajectory
+func NewPolynomialSwing(liftOff, touchDown Vec3, height float64) Trajectory {
+	return &PolynomialTrajectory{
+		LiftOff:   liftOff,
+		TouchDown: touchDown,
+		Height:    height,
+	}
+}
+
+// Position evaluates the polynomials at phase
+func (p *PolynomialTrajectory) Position(phase float64) Vec3 {
+	stride := quintic(phase)
+	lift := p.Height * quintic(2*phase)
+	if phase > 0.5 {
+		lift = p.Height * quintic(2-2*phase)
+	}
+	return p.LiftOff.Add(p.TouchDown.Sub(p.LiftOff).Mul(stride)).Add(Up.Mul(lift))
+}
+
+// quintic is the quintic polynomial from 0 to 1, with zero velocity and acceleration at both ends
+func quintic(t float64) float64 {
+	t = clamp(t, 0, 1)
+	return t * t * t * (10 + t*(-15+6*t))
+}
+
+// StanceTrajectory moves a foot in a straight line along the ground, from where it touches down to where it lifts off.
+// The foot can also be pushed slightly into the ground half way through the stance, which helps to keep the robot's weight on it
+type StanceTrajectory struct {
+	TouchDown Vec3
+	LiftOff   Vec3
+	Depth     float64
+}
+
+// NewStanceTrajectory creates a stance trajectory. Depth is how far the foot is pushed down half way through the stance (0 for a straight line)
+func NewStanceTrajectory(touchDown, liftOff Vec3, depth float64) *StanceTrajectory {
+	return &StanceTrajectory{
+		TouchDown: touchDown,
+		LiftOff:   liftOff,
+		Depth:     depth,
+	}
+}
+
+// NewSineStance creates a StanceTrajectory, for use as a StanceGenerator
+func NewSineStance(touchDown, liftOff Vec3, depth float64) Trajectory {
+	return NewStanceTrajectory(touchDown, liftOff, depth)
+}
+
+// Position evaluates the stance trajectory at phase
+func (s *StanceTrajectory) Position(phase float64) Vec3 {
+	return s.TouchDown.Add(s.LiftOff.Sub(s.TouchDown).Mul(phase)).Add(Down.Mul(s.Depth * math.Sin(math.Pi*phase)))
+}
@@ -0,0 +1,108 @@
+package spotpuppy
+
+import "sync"
+
+// backgroundUpdater runs the update thread of a rotation sensor, and keeps the last rotation and error from it.
+// It is embedded in rotation sensors that read their hardware in the background, and gives them Start, Stop, Restart, Err and GetQuaternion
+type backgroundUpdater struct {
+	// launch checks that the sensor is set up, then starts its update thread, which must return when stop is closed, and close done when it has returned.
+	// It is set by the sensor's constructor
+	launch func(stop <-chan struct{}, done chan<- struct{}) error
+	// lifecycle is held while starting, stopping or calibrating, so they cannot happen at the same time
+	lifecycle sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+	// mu protects everything below it, which is shared with the update thread
+	mu        sync.Mutex
+	cachedRot Quat
+	err       error
+}
+
+// newBackgroundUpdater creates an updater that starts update threads with launch
+func newBackgroundUpdater(launch func(stop <-chan struct{}, done chan<- struct{}) error) backgroundUpdater {
+	return backgroundUpdater{
+		launch:    launch,
+		cachedRot: QuatIdentity,
+	}
+}
+
+// Start starts updating the rotation in the background. It does nothing if the sensor is already updating
+func (u *backgroundUpdater) Start() error {
+	u.lifecycle.Lock()
+	defer u.lifecycle.Unlock()
+	return u.start()
+}
+
+// Stop stops updating the rotation in the background, and waits for the update thread to finish. GetQuaternion keeps returning the last measured rotation
+func (u *backgroundUpdater) Stop() {
+	u.lifecycle.Lock()
+	defer u.lifecycle.Unlock()
+	u.stopAndWait()
+}
+
+// Restarts the updating in background thread. This can be used to start reading again after a read error (see Err)
+func (u *backgroundUpdater) Restart() error {
+	u.lifecycle.Lock()
+	defer u.lifecycle.Unlock()
+	u.stopAndWait()
+	return u.start()
+}
+
+// Err returns the error that stopped the sensor from reading its hardware, or nil if it is reading normally.
+// While there is an error, GetQuaternion returns the last rotation that was measured
+func (u *backgroundUpdater) Err() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err
+}
+
+// Returns the last measured rotation of the sensor. Non blocking
+func (u *backgroundUpdater) GetQuaternion() Quat {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.cachedRot
+}
+
+// start starts the update thread if it is not running. lifecycle must be held
+func (u *backgroundUpdater) start() error {
+	if u.done != nil {
+		select {
+		case <-u.done:
+			// The update thread stopped by itself after an error
+		default:
+			return nil
+		}
+	}
+	u.setErr(nil)
+	stop, done := make(chan struct{}), make(chan struct{})
+	err := u.launch(stop, done)
+	if err != nil {
+		return err
+	}
+	u.stop, u.done = stop, done
+	return nil
+}
+
+// stopAndWait stops the update thread if it is running, and waits for it to finish. lifecycle must be held
+func (u *backgroundUpdater) stopAndWait() {
+	if u.done == nil {
+		return
+	}
+	close(u.stop)
+	<-u.done
+	u.stop, u.done = nil, nil
+}
+
+// setErr sets the error returned by Err
+func (u *backgroundUpdater) setErr(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.err = err
+}
+
+// setRotation sets the rotation returned by GetQuaternion
+func (u *backgroundUpdater) setRotation(q Quat) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.cachedRot = q
+}
@@ -0,0 +1,106 @@
+package spotpuppy
+
+import (
+	"errors"
+	"math"
+)
+
+// Workspace is a grid of sampled foot positions, recording which of them a leg can reach.
+// It can be used by gait code to keep foot positions inside the area that the leg can actually reach
+type Workspace struct {
+	// Min is the corner of the sampled box with the smallest coordinates
+	Min Vec3
+	// Max is the corner of the sampled box with the largest coordinates
+	Max Vec3
+	// Step is the distance between samples along each axis
+	Step       float64
+	nx, ny, nz int
+	reachable  []bool
+}
+
+// SampleWorkspace tests every point on a grid (with spacing step) inside the box from min to max, and records which points the leg can reach.
+// Positions are relative to the leg, in the same way as for CalculateMotorRotations.
+// Returns an error if step is not more than 0, or max is smaller than min on any axis
+func SampleWorkspace(ik LegIK, min, max Vec3, step float64) (*Workspace, error) {
+	if !(step > 0) || math.IsInf(step, 1) {
+		return nil, errors.New("workspace step must be more than 0")
+	}
+	if !(max.X >= min.X && max.Y >= min.Y && max.Z >= min.Z) {
+		return nil, errors.New("workspace max must not be smaller than min on any axis")
+	}
+	size := max.Sub(min)
+	if math.IsInf(size.X+size.Y+size.Z, 0) || math.IsNaN(size.X+size.Y+size.Z) {
+		return nil, errors.New("workspace must be a finite size")
+	}
+	w := &Workspace{
+		Min:  min,
+		Max:  max,
+		Step: step,
+		nx:   int(math.Floor((max.X-min.X)/step)) + 1,
+		ny:   int(math.Floor((max.Y-min.Y)/step)) + 1,
+		nz:   int(math.Floor((max.Z-min.Z)/step)) + 1,
+	}
+	w.reachable = make([]bool, w.nx*w.ny*w.nz)
+	for x := 0; x < w.nx; x++ {
+		for y := 0; y < w.ny; y++ {
+			for z := 0; z < w.nz; z++ {
+				w.reachable[w.index(x, y, z)] = SolveLegIK(ik, w.position(x, y, z)).Reachable
+			}
+		}
+	}
+	return w, nil
+}
+
+func (w *Workspace) index(x, y, z int) int {
+	return (x*w.ny+y)*w.nz + z
+}
+
+func (w *Workspace) position(x, y, z int) Vec3 {
+	return w.Min.Add(NewVector3(float64(x), float64(y), float64(z)).Mul(w.Step))
+}
+
+// cell finds the grid cell closest to pos. ok is false if pos is outside of the sampled box
+func (w *Workspace) cell(pos Vec3) (x, y, z int, ok bool) {
+	d := pos.Sub(w.Min).Mul(1 / w.Step)
+	x, y, z = int(math.Round(d.X)), int(math.Round(d.Y)), int(math.Round(d.Z))
+	ok = x >= 0 && x < w.nx && y >= 0 && y < w.ny && z >= 0 && z < w.nz
+	return x, y, z, ok
+}
+
+// Contains returns true if the sample closest to pos is reachable. Positions outside of the sampled box are never contained
+func (w *Workspace) Contains(pos Vec3) bool {
+	x, y, z, ok := w.cell(pos)
+	return ok && w.reachable[w.index(x, y, z)]
+}
+
+// Points returns all of the reachable sample positions
+func (w *Workspace) Points() []Vec3 {
+	points := make([]Vec3, 0)
+	for x := 0; x < w.nx; x++ {
+		for y := 0; y < w.ny; y++ {
+			for z := 0; z < w.nz; z++ {
+				if w.reachable[w.index(x, y, z)] {
+					points = append(points, w.position(x, y, z))
+				}
+			}
+		}
+	}
+	return points
+}
+
+// Nearest returns pos if it is contained in the workspace, otherwise it returns the closest reachable sample position.
+// If there are no reachable positions at all, pos is returned
+func (w *Workspace) Nearest(pos Vec3) Vec3 {
+	if w.Contains(pos) {
+		return pos
+	}
+	nearest := pos
+	nearestDist := math.Inf(1)
+	for _, p := range w.Points() {
+		if d := p.Sub(pos).Len(); d < nearestDist {
+			nearest = p
+			nearestDist = d
+		}
+	}
+	return nearest
+}